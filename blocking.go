@@ -0,0 +1,188 @@
+package xmppclient
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"strings"
+)
+
+// Blocking Command, XEP-0191, and Spam Reporting, XEP-0377
+// http://xmpp.org/extensions/xep-0191.html
+// http://xmpp.org/extensions/xep-0377.html
+
+// Reasons for reporting a blocked JID.
+const (
+	ReportSpam  = "urn:xmpp:reporting:spam"
+	ReportAbuse = "urn:xmpp:reporting:abuse"
+)
+
+// Report tells the server why a JID is being blocked.
+type Report struct {
+	// Reason is ReportSpam or ReportAbuse.
+	Reason string
+	Text   string
+	// StanzaIds point the server to the offending messages.
+	StanzaIds []StanzaId
+}
+
+// BlockList fetches the JIDs we block and replaces the local cache used to
+// filter stanzas with it. It needs Listen to be running.
+//
+//	<iq type='get' id='blocklist1'>
+//	  <blocklist xmlns='urn:xmpp:blocking'/>
+//	</iq>
+func (c *Conn) BlockList(ctx context.Context) ([]string, error) {
+	iq, err := c.sendIQ(ctx, "", "get", "<blocklist xmlns='"+nsBlocking+"'/>")
+	if err != nil {
+		return nil, err
+	}
+	var list BlockingCommand
+	if err = unmarshalQuery(iq, &list); err != nil {
+		return nil, err
+	}
+
+	jids := make([]string, 0, len(list.Items))
+	blocked := make(map[string]bool)
+	for _, item := range list.Items {
+		jids = append(jids, item.Jid)
+		blocked[item.Jid] = true
+	}
+	c.blockMu.Lock()
+	c.blocked = blocked
+	c.blockMu.Unlock()
+	return jids, nil
+}
+
+// Block blocks communication with jids, which may be full or bare JIDs or
+// domains.
+//
+//	<iq type='set' id='block1'>
+//	  <block xmlns='urn:xmpp:blocking'>
+//	    <item jid='romeo@montague.net'/>
+//	  </block>
+//	</iq>
+func (c *Conn) Block(ctx context.Context, jids ...string) error {
+	var items strings.Builder
+	for _, jid := range jids {
+		fmt.Fprintf(&items, "<item jid='%s'/>", xmlEscape(jid))
+	}
+	return c.sendBlocking(ctx, "block", items.String(), jids)
+}
+
+// BlockAndReport blocks jid and reports it to the server for spam or abuse.
+//
+//	<iq type='set' id='block1'>
+//	  <block xmlns='urn:xmpp:blocking'>
+//	    <item jid='romeo@example.net'>
+//	      <report xmlns='urn:xmpp:reporting:1' reason='urn:xmpp:reporting:spam'>
+//	        <stanza-id xmlns='urn:xmpp:sid:0' by='romeo@example.net' id='28482-98726-73623'/>
+//	        <text>Never came trouble to my house like this.</text>
+//	      </report>
+//	    </item>
+//	  </block>
+//	</iq>
+func (c *Conn) BlockAndReport(ctx context.Context, jid string, report Report) error {
+	reason := report.Reason
+	if reason == "" {
+		reason = ReportSpam
+	}
+
+	var item strings.Builder
+	fmt.Fprintf(&item, "<item jid='%s'><report xmlns='%s' reason='%s'>", xmlEscape(jid), nsReporting, xmlEscape(reason))
+	for _, id := range report.StanzaIds {
+		fmt.Fprintf(&item, "<stanza-id xmlns='%s' by='%s' id='%s'/>", nsSid, xmlEscape(id.By), xmlEscape(id.Id))
+	}
+	if report.Text != "" {
+		fmt.Fprintf(&item, "<text>%s</text>", xmlEscape(report.Text))
+	}
+	item.WriteString("</report></item>")
+	return c.sendBlocking(ctx, "block", item.String(), []string{jid})
+}
+
+// Unblock unblocks jids.
+//
+//	<iq type='set' id='unblock1'>
+//	  <unblock xmlns='urn:xmpp:blocking'>
+//	    <item jid='romeo@montague.net'/>
+//	  </unblock>
+//	</iq>
+func (c *Conn) Unblock(ctx context.Context, jids ...string) error {
+	var items strings.Builder
+	for _, jid := range jids {
+		fmt.Fprintf(&items, "<item jid='%s'/>", xmlEscape(jid))
+	}
+	return c.sendBlocking(ctx, "unblock", items.String(), jids)
+}
+
+// UnblockAll empties the block list.
+func (c *Conn) UnblockAll(ctx context.Context) error {
+	return c.sendBlocking(ctx, "unblock", "", nil)
+}
+
+func (c *Conn) sendBlocking(ctx context.Context, command, items string, jids []string) error {
+	if _, err := c.sendIQ(ctx, "", "set", fmt.Sprintf("<%s xmlns='%s'>%s</%s>", command, nsBlocking, items, command)); err != nil {
+		return err
+	}
+	c.updateBlocked(command, jids)
+	return nil
+}
+
+// updateBlocked applies a block or unblock command to the local cache. An
+// unblock without items unblocks everybody.
+func (c *Conn) updateBlocked(command string, jids []string) {
+	c.blockMu.Lock()
+	defer c.blockMu.Unlock()
+	if command == "unblock" && len(jids) == 0 {
+		c.blocked = make(map[string]bool)
+		return
+	}
+	for _, jid := range jids {
+		if command == "block" {
+			c.blocked[jid] = true
+		} else {
+			delete(c.blocked, jid)
+		}
+	}
+}
+
+// answerBlockPush applies the changes the server pushes to all our resources
+// when one of them blocks or unblocks somebody.
+func (c *Conn) answerBlockPush(iq *ClientIQ) (string, error) {
+	if !c.isReplyFrom("", iq.From) {
+		return "", NewStanzaError("cancel", "not-allowed")
+	}
+	var push BlockingCommand
+	if err := xml.Unmarshal(iq.Query, &push); err != nil {
+		return "", NewStanzaError("modify", "bad-request")
+	}
+	jids := make([]string, 0, len(push.Items))
+	for _, item := range push.Items {
+		jids = append(jids, item.Jid)
+	}
+	c.updateBlocked(push.XMLName.Local, jids)
+	return "", nil
+}
+
+// IsBlocked reports whether stanzas from jid are blocked, according to the
+// local cache. Like the server, it matches the full JID, the bare JID, the
+// domain with the resource and the domain.
+func (c *Conn) IsBlocked(jid string) bool {
+	if jid == "" {
+		return false
+	}
+	c.blockMu.RLock()
+	defer c.blockMu.RUnlock()
+	if len(c.blocked) == 0 {
+		return false
+	}
+
+	bare := RemoveResourceFromJid(jid)
+	domain := bare
+	if at := strings.Index(bare, "@"); at != -1 {
+		domain = bare[at+1:]
+	}
+	resource := strings.TrimPrefix(jid, bare)
+
+	return c.blocked[jid] || c.blocked[bare] || c.blocked[domain+resource] || c.blocked[domain]
+}
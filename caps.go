@@ -0,0 +1,290 @@
+package xmppclient
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultCapsNode is advertised as the caps node when Config.CapsNode is empty.
+const DefaultCapsNode = "https://github.com/bom-d-van/xmppclient"
+
+// The hash used for our own verification string. sha-1 is the one every
+// implementation is required to support.
+const capsHash = "sha-1"
+
+var capsHashes = map[string]func() hash.Hash{
+	"sha-1":   sha1.New,
+	"sha-224": sha256.New224,
+	"sha-256": sha256.New,
+	"sha-384": sha512.New384,
+	"sha-512": sha512.New,
+}
+
+// CapsVerification computes the XEP-0115 verification string of info using
+// the named hash function (an IANA name such as "sha-1").
+// See http://xmpp.org/extensions/xep-0115.html#ver
+func CapsVerification(info *DiscoveryReply, hashName string) (string, error) {
+	newHash, ok := capsHashes[hashName]
+	if !ok {
+		return "", errors.New("xmpp: unsupported caps hash " + hashName)
+	}
+
+	var s capsString
+	identities := make([]string, 0, len(info.Identities))
+	for _, i := range info.Identities {
+		identities = append(identities, i.Category+"/"+i.Type+"/"+i.Lang+"/"+i.Name)
+	}
+	sort.Strings(identities)
+	for _, i := range identities {
+		s.add(i)
+	}
+
+	features := make([]string, 0, len(info.Features))
+	for _, f := range info.Features {
+		features = append(features, f.Var)
+	}
+	sort.Strings(features)
+	for _, f := range features {
+		s.add(f)
+	}
+
+	forms := make([]*DataForm, 0, len(info.Forms))
+	for i := range info.Forms {
+		if info.Forms[i].FormType() != "" {
+			forms = append(forms, &info.Forms[i])
+		}
+	}
+	sort.Sort(formsByType(forms))
+	for _, form := range forms {
+		s.add(form.FormType())
+
+		fields := make([]DataFormField, 0, len(form.Fields))
+		for _, field := range form.Fields {
+			if field.Var != "FORM_TYPE" {
+				fields = append(fields, field)
+			}
+		}
+		sort.Sort(fieldsByVar(fields))
+		for _, field := range fields {
+			s.add(field.Var)
+			values := append([]string(nil), field.Values...)
+			sort.Strings(values)
+			for _, v := range values {
+				s.add(v)
+			}
+		}
+	}
+
+	h := newHash()
+	h.Write([]byte(s.String()))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// VerifyCaps checks that info, the disco#info result of the entity that sent
+// caps, hashes to the advertised verification string. It also rejects
+// results that XEP-0115 considers poisoned, such as duplicate identities or
+// features.
+func VerifyCaps(caps PresenceC, info *DiscoveryReply) error {
+	seen := make(map[string]bool)
+	for _, i := range info.Identities {
+		key := "identity " + i.Category + "/" + i.Type + "/" + i.Lang + "/" + i.Name
+		if seen[key] {
+			return errors.New("xmpp: caps: duplicate identity " + i.Category + "/" + i.Type)
+		}
+		seen[key] = true
+	}
+	for _, f := range info.Features {
+		if seen["feature "+f.Var] {
+			return errors.New("xmpp: caps: duplicate feature " + f.Var)
+		}
+		seen["feature "+f.Var] = true
+	}
+	for _, form := range info.Forms {
+		formType := form.FormType()
+		if formType == "" {
+			continue
+		}
+		if seen["form "+formType] {
+			return errors.New("xmpp: caps: duplicate form " + formType)
+		}
+		seen["form "+formType] = true
+	}
+
+	ver, err := CapsVerification(info, caps.Hash)
+	if err != nil {
+		return err
+	}
+	if ver != caps.Ver {
+		return fmt.Errorf("xmpp: caps: verification string mismatch, got %s want %s", ver, caps.Ver)
+	}
+	return nil
+}
+
+// capsString builds the '<' separated string that gets hashed.
+type capsString struct{ strings.Builder }
+
+func (b *capsString) add(s string) {
+	b.WriteString(s)
+	b.WriteByte('<')
+}
+
+type formsByType []*DataForm
+
+func (f formsByType) Len() int           { return len(f) }
+func (f formsByType) Less(i, j int) bool { return f[i].FormType() < f[j].FormType() }
+func (f formsByType) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+
+type fieldsByVar []DataFormField
+
+func (f fieldsByVar) Len() int           { return len(f) }
+func (f fieldsByVar) Less(i, j int) bool { return f[i].Var < f[j].Var }
+func (f fieldsByVar) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+
+// CapsStore persists verified capabilities so they survive restarts. The
+// cache consults it on misses and writes every newly verified entry to it.
+type CapsStore interface {
+	LoadCaps(ver string) (*DiscoveryReply, error)
+	StoreCaps(ver string, info *DiscoveryReply) error
+}
+
+// ErrCapsNotFound is returned by a CapsStore that has no entry for a ver.
+var ErrCapsNotFound = errors.New("xmpp: caps not found")
+
+// CapsCache maps verification strings to the disco#info they stand for, and
+// remembers which verification string each peer last advertised.
+type CapsCache struct {
+	mu      sync.RWMutex
+	entries map[string]*DiscoveryReply
+	peers   map[string]PresenceC
+	store   CapsStore
+}
+
+// NewCapsCache returns an empty cache backed by store, which may be nil.
+func NewCapsCache(store CapsStore) *CapsCache {
+	return &CapsCache{
+		entries: make(map[string]*DiscoveryReply),
+		peers:   make(map[string]PresenceC),
+		store:   store,
+	}
+}
+
+// Get returns the capabilities stored under ver.
+func (cc *CapsCache) Get(ver string) (*DiscoveryReply, bool) {
+	cc.mu.RLock()
+	info, ok := cc.entries[ver]
+	cc.mu.RUnlock()
+	if ok || cc.store == nil {
+		return info, ok
+	}
+
+	info, err := cc.store.LoadCaps(ver)
+	if err != nil || info == nil {
+		return nil, false
+	}
+	cc.mu.Lock()
+	cc.entries[ver] = info
+	cc.mu.Unlock()
+	return info, true
+}
+
+// Put verifies info against caps and, if it matches, caches it under
+// caps.Ver.
+func (cc *CapsCache) Put(caps PresenceC, info *DiscoveryReply) error {
+	if err := VerifyCaps(caps, info); err != nil {
+		return err
+	}
+
+	cc.mu.Lock()
+	cc.entries[caps.Ver] = info
+	cc.mu.Unlock()
+	if cc.store != nil {
+		return cc.store.StoreCaps(caps.Ver, info)
+	}
+	return nil
+}
+
+// Peer returns the caps last advertised by jid.
+func (cc *CapsCache) Peer(jid string) (PresenceC, bool) {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+	caps, ok := cc.peers[jid]
+	return caps, ok
+}
+
+// Lookup returns the cached capabilities of jid, if its advertised
+// verification string is known.
+func (cc *CapsCache) Lookup(jid string) (*DiscoveryReply, bool) {
+	caps, ok := cc.Peer(jid)
+	if !ok {
+		return nil, false
+	}
+	return cc.Get(caps.Ver)
+}
+
+func (cc *CapsCache) setPeer(jid string, caps PresenceC) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if caps.Ver == "" {
+		delete(cc.peers, jid)
+		return
+	}
+	cc.peers[jid] = caps
+}
+
+// CapsInfo returns the capabilities of jid. If jid advertised a verification
+// string that is not cached yet, it is resolved with disco#info, verified and
+// cached; peers without caps are simply queried.
+func (c *Conn) CapsInfo(ctx context.Context, jid string) (*DiscoveryReply, error) {
+	caps, ok := c.Caps.Peer(jid)
+	if !ok {
+		return c.DiscoInfo(ctx, jid, "")
+	}
+	if info, ok := c.Caps.Get(caps.Ver); ok {
+		return info, nil
+	}
+
+	info, err := c.DiscoInfo(ctx, jid, caps.Node+"#"+caps.Ver)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.Caps.Put(caps, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// HasFeature reports whether info advertises the feature var.
+func (info *DiscoveryReply) HasFeature(v string) bool {
+	for _, f := range info.Features {
+		if f.Var == v {
+			return true
+		}
+	}
+	return false
+}
+
+// CapsVer returns the verification string advertised in our presence.
+func (c *Conn) CapsVer() string {
+	ver, _ := CapsVerification(c.discoInfo(), capsHash)
+	return ver
+}
+
+// capsElement returns the <c/> element to attach to available presence.
+func (c *Conn) capsElement() string {
+	return fmt.Sprintf(
+		"<c xmlns='%s' hash='%s' node='%s' ver='%s'/>",
+		nsCaps,
+		capsHash,
+		xmlEscape(c.capsNode),
+		xmlEscape(c.CapsVer()),
+	)
+}
@@ -0,0 +1,79 @@
+package xmppclient
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+// The examples of XEP-0115, sections 5.2 and 5.3.
+var capsExamples = []struct {
+	name  string
+	query string
+	ver   string
+}{
+	{
+		"simple",
+		`<query xmlns='http://jabber.org/protocol/disco#info' node='http://code.google.com/p/exodus#QgayPKawpkPSDYmwT/WM94uAlu0='>
+		  <identity category='client' name='Exodus 0.9.1' type='pc'/>
+		  <feature var='http://jabber.org/protocol/caps'/>
+		  <feature var='http://jabber.org/protocol/disco#info'/>
+		  <feature var='http://jabber.org/protocol/disco#items'/>
+		  <feature var='http://jabber.org/protocol/muc'/>
+		</query>`,
+		"QgayPKawpkPSDYmwT/WM94uAlu0=",
+	},
+	{
+		"complex",
+		`<query xmlns='http://jabber.org/protocol/disco#info' node='http://psi-im.org#q07IKJEyjvHSyhy//CH0CxmKi8w='>
+		  <identity xml:lang='en' category='client' name='Psi 0.11' type='pc'/>
+		  <identity xml:lang='el' category='client' name='Ψ 0.11' type='pc'/>
+		  <feature var='http://jabber.org/protocol/caps'/>
+		  <feature var='http://jabber.org/protocol/disco#info'/>
+		  <feature var='http://jabber.org/protocol/disco#items'/>
+		  <feature var='http://jabber.org/protocol/muc'/>
+		  <x xmlns='jabber:x:data' type='result'>
+		    <field var='FORM_TYPE' type='hidden'>
+		      <value>urn:xmpp:dataforms:softwareinfo</value>
+		    </field>
+		    <field var='ip_version'>
+		      <value>ipv6</value>
+		      <value>ipv4</value>
+		    </field>
+		    <field var='software_version'>
+		      <value>0.11</value>
+		    </field>
+		    <field var='os'>
+		      <value>Mac</value>
+		    </field>
+		    <field var='os_version'>
+		      <value>10.5.1</value>
+		    </field>
+		    <field var='software'>
+		      <value>Psi</value>
+		    </field>
+		  </x>
+		</query>`,
+		"q07IKJEyjvHSyhy//CH0CxmKi8w=",
+	},
+}
+
+func TestCapsVerification(t *testing.T) {
+	for _, test := range capsExamples {
+		var info DiscoveryReply
+		if err := xml.Unmarshal([]byte(test.query), &info); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		ver, err := CapsVerification(&info, "sha-1")
+		if err != nil || ver != test.ver {
+			t.Errorf("%s: got %s, %v, want %s", test.name, ver, err, test.ver)
+		}
+		if err := VerifyCaps(PresenceC{Hash: "sha-1", Ver: test.ver}, &info); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+
+		info.Features = append(info.Features, info.Features[0])
+		if err := VerifyCaps(PresenceC{Hash: "sha-1", Ver: test.ver}, &info); err == nil {
+			t.Errorf("%s: duplicate feature accepted", test.name)
+		}
+	}
+}
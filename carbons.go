@@ -0,0 +1,69 @@
+package xmppclient
+
+import "context"
+
+// Message Carbons, XEP-0280
+// http://xmpp.org/extensions/xep-0280.html
+
+const (
+	CarbonSent     = "sent"
+	CarbonReceived = "received"
+)
+
+// EnableCarbons asks the server to copy to this resource the messages our
+// other resources send and receive. Copies are delivered to the Handler
+// unwrapped, with ClientMessage.Carbon set.
+//
+//	<iq type='set' id='enable1'>
+//	  <enable xmlns='urn:xmpp:carbons:2'/>
+//	</iq>
+func (c *Conn) EnableCarbons(ctx context.Context) error {
+	_, err := c.sendIQ(ctx, "", "set", "<enable xmlns='"+nsCarbons+"'/>")
+	return err
+}
+
+// DisableCarbons stops the server from copying messages to this resource.
+func (c *Conn) DisableCarbons(ctx context.Context) error {
+	_, err := c.sendIQ(ctx, "", "set", "<disable xmlns='"+nsCarbons+"'/>")
+	return err
+}
+
+// PrivateMessage keeps the server from sending carbon copies of the message
+// to our other resources.
+func PrivateMessage() MessageOption {
+	return func(m *outgoingMessage) {
+		m.extensions.WriteString("<private xmlns='" + nsCarbons + "'/>")
+	}
+}
+
+// unwrapCarbon returns the message carried by a carbon copy, flagged with its
+// direction. Carbons can only come from our own account; anything else is a
+// spoofing attempt and nil is returned.
+//
+//	<message from='romeo@montague.example' to='romeo@montague.example/home' type='chat'>
+//	  <received xmlns='urn:xmpp:carbons:2'>
+//	    <forwarded xmlns='urn:xmpp:forward:0'>
+//	      <message xmlns='jabber:client' from='juliet@capulet.example/balcony' ...>
+//	        <body>What man art thou that, thus bescreen'd in night, so stumblest on my counsel?</body>
+//	      </message>
+//	    </forwarded>
+//	  </received>
+//	</message>
+func (c *Conn) unwrapCarbon(msg *ClientMessage) *ClientMessage {
+	if msg.From != RemoveResourceFromJid(c.Jid) {
+		return nil
+	}
+
+	var inner *ClientMessage
+	var direction string
+	if msg.CarbonSent != nil {
+		inner, direction = msg.CarbonSent.Forwarded.Message, CarbonSent
+	} else {
+		inner, direction = msg.CarbonReceived.Forwarded.Message, CarbonReceived
+	}
+	if inner == nil {
+		return nil
+	}
+	inner.Carbon = direction
+	return inner
+}
@@ -0,0 +1,151 @@
+package xmppclient
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Chat State Notifications, XEP-0085
+// http://xmpp.org/extensions/xep-0085.html
+
+const (
+	ChatStateActive    = "active"
+	ChatStateComposing = "composing"
+	ChatStatePaused    = "paused"
+	ChatStateInactive  = "inactive"
+	ChatStateGone      = "gone"
+)
+
+// ChatStateConfig sets how long the chat state machine waits before moving a
+// conversation to the next state. Zero values use the defaults suggested by
+// XEP-0085.
+type ChatStateConfig struct {
+	// Paused is how long after the last Typing call composing turns into
+	// paused. Defaults to 30 seconds.
+	Paused time.Duration
+	// Inactive is how long active or paused lasts before turning into
+	// inactive. Defaults to 2 minutes.
+	Inactive time.Duration
+	// Gone is how long inactive lasts before turning into gone. Defaults to
+	// 10 minutes.
+	Gone time.Duration
+}
+
+// chatStateMachine sends a chat state only when it changes, and moves each
+// conversation along composing, paused, inactive and gone on timers.
+type chatStateMachine struct {
+	c     *Conn
+	cfg   ChatStateConfig
+	mu    sync.Mutex
+	convs map[string]*chatStateConv
+}
+
+type chatStateConv struct {
+	to    string
+	state string
+	gen   int // bumped on every transition, to spot stale timers
+	timer *time.Timer
+}
+
+func newChatStateMachine(c *Conn, cfg ChatStateConfig) *chatStateMachine {
+	if cfg.Paused <= 0 {
+		cfg.Paused = 30 * time.Second
+	}
+	if cfg.Inactive <= 0 {
+		cfg.Inactive = 2 * time.Minute
+	}
+	if cfg.Gone <= 0 {
+		cfg.Gone = 10 * time.Minute
+	}
+	return &chatStateMachine{c: c, cfg: cfg, convs: make(map[string]*chatStateConv)}
+}
+
+// Typing reports that the user is typing a message to the given user. With
+// the chat state machine enabled, composing is sent once and turns into
+// paused when Typing is not called again in time; otherwise composing is
+// sent every time.
+func (c *Conn) Typing(to string) error {
+	if c.chatStates == nil {
+		return c.SendComposing(to)
+	}
+	return c.chatStates.transition(to, ChatStateComposing, true)
+}
+
+// LeaveChat reports that the user closed the chat with the given user, and
+// stops tracking its state.
+func (c *Conn) LeaveChat(to string) error {
+	if c.chatStates == nil {
+		return c.SendGone(to)
+	}
+	return c.chatStates.transition(to, ChatStateGone, true)
+}
+
+// sending attaches <active/> to a message body sent to to.
+func (m *chatStateMachine) sending(to string, msg *outgoingMessage) {
+	m.transition(to, ChatStateActive, false)
+	fmt.Fprintf(&msg.extensions, "<%s xmlns='%s'/>", ChatStateActive, nsChatStates)
+}
+
+// transition moves the conversation with to into state, sending a
+// notification if notify is set and the state changed, and schedules the
+// next automatic transition.
+func (m *chatStateMachine) transition(to, state string, notify bool) error {
+	key := RemoveResourceFromJid(to)
+
+	m.mu.Lock()
+	conv, ok := m.convs[key]
+	if !ok {
+		conv = &chatStateConv{}
+		m.convs[key] = conv
+	}
+	conv.to = to
+	changed := conv.state != state
+	conv.state = state
+	conv.gen++
+	if conv.timer != nil {
+		conv.timer.Stop()
+		conv.timer = nil
+	}
+
+	var next string
+	var after time.Duration
+	switch state {
+	case ChatStateComposing:
+		next, after = ChatStatePaused, m.cfg.Paused
+	case ChatStateActive, ChatStatePaused:
+		next, after = ChatStateInactive, m.cfg.Inactive
+	case ChatStateInactive:
+		next, after = ChatStateGone, m.cfg.Gone
+	case ChatStateGone:
+		delete(m.convs, key)
+	}
+	if next != "" {
+		gen := conv.gen
+		conv.timer = time.AfterFunc(after, func() { m.expire(key, conv, gen, next) })
+	}
+	m.mu.Unlock()
+
+	if notify && changed {
+		return m.c.sendChatState(to, state)
+	}
+	return nil
+}
+
+// expire moves conv to next, unless something else happened to the
+// conversation since the timer was set.
+func (m *chatStateMachine) expire(key string, conv *chatStateConv, gen int, next string) {
+	select {
+	case <-m.c.done:
+		return
+	default:
+	}
+
+	m.mu.Lock()
+	current := m.convs[key] == conv && conv.gen == gen
+	to := conv.to
+	m.mu.Unlock()
+	if current {
+		m.transition(to, next, true)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"log"
+	"sync"
+	"time"
 
 	"crypto/tls"
 	"crypto/x509"
@@ -13,6 +15,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 )
 
 // Conn represents a connection to an XMPP server.
@@ -31,6 +34,71 @@ type Conn struct {
 	OnlineRoster []string
 	Handler      Handler
 	RosterIQMap  map[string]chan *ClientIQ
+
+	// Caps holds the entity capabilities (XEP-0115) advertised by peers.
+	Caps *CapsCache
+	// StreamLang is the default language of the stanzas the server sends.
+	StreamLang string
+	lang       string
+
+	capsNode   string
+	identities []DiscoveryIdentity
+	features   []string
+
+	discoMu    sync.RWMutex
+	discoNodes map[string]discoNode
+
+	iqMu       sync.Mutex
+	pendingIQ  map[string]chan *ClientIQ
+	iqHandlers map[string]IQHandlerFunc
+	done       chan struct{}
+	closeOnce  sync.Once
+	errMu      sync.Mutex
+	err        error
+
+	keepAlive       time.Duration
+	keepAliveMisses int
+
+	sendReceipts bool
+
+	markersMu     sync.Mutex
+	conversations map[string]*conversation
+	markersClock  uint64
+
+	chatStates *chatStateMachine
+
+	mamMu      sync.Mutex
+	mamQueries map[string]*archivePage
+
+	httpClient    *http.Client
+	uploadMu      sync.Mutex
+	uploadService *UploadService
+
+	ibbMu        sync.Mutex
+	ibbStreams   map[string]*IBBStream
+	ibbExpect    map[string]chan *IBBStream
+	ibbBlockSize int
+	ibbAccept    bool
+
+	s5Addr     string
+	s5Accept   bool
+	s5Once     sync.Once
+	s5Listener net.Listener
+	s5Mu       sync.Mutex
+	s5Pending  map[string]chan net.Conn
+	s5Proxies  []StreamHost
+
+	jingleMu       sync.Mutex
+	jingleSessions map[string]*JingleSession
+	jingleAccept   bool
+
+	roomsMu sync.Mutex
+	rooms   map[string]bool // rooms we joined
+
+	blockMu sync.RWMutex
+	blocked map[string]bool
+
+	omemo *omemoState
 }
 
 // Config contains options for an XMPP connection.
@@ -46,17 +114,89 @@ type Config struct {
 	Log io.Writer
 
 	TLSRequired bool
+
+	// Lang is the default language of the stanzas we send, declared as the
+	// xml:lang of our stream.
+	Lang string
+
+	// CapsNode is the node advertised in our entity capabilities. It
+	// defaults to DefaultCapsNode.
+	CapsNode string
+	// CapsStore optionally persists the capabilities cache.
+	CapsStore CapsStore
+	// Identities replaces the default client/pc identity answered to
+	// disco#info queries.
+	Identities []DiscoveryIdentity
+
+	// Version is answered to software version (XEP-0092) queries. When nil,
+	// the library name and module version are used and the OS is left out.
+	Version *VersionReply
+	// HideVersion disables answering software version queries altogether.
+	HideVersion bool
+
+	// KeepAlive, when positive, makes Listen ping the server (XEP-0199)
+	// every KeepAlive. A ping counts as missed when no reply arrives within
+	// the interval, and after KeepAliveMisses (default 3) consecutive misses
+	// the connection is closed, Listen returns, and Err reports
+	// ErrKeepAliveTimeout.
+	KeepAlive       time.Duration
+	KeepAliveMisses int
+
+	// DisableReceipts stops answering delivery receipt (XEP-0184) requests,
+	// for users who do not want to reveal when they are online.
+	DisableReceipts bool
+
+	// InitialPresence makes Dial send our initial presence. Servers flush
+	// stored offline messages once it is sent, so leave it unset to retrieve
+	// them with OfflineHeaders first, and call SignalPresence afterwards.
+	InitialPresence bool
+
+	// ChatStates, when not nil, enables the automatic chat state machine.
+	// See Conn.Typing.
+	ChatStates *ChatStateConfig
+
+	// HTTPClient is used for HTTP file uploads. Defaults to
+	// http.DefaultClient.
+	HTTPClient *http.Client
+
+	// AcceptIBB, AcceptSOCKS5 and AcceptJingle make us accept, and
+	// advertise, in-band bytestreams, SOCKS5 bytestreams and Jingle file
+	// transfers offered by peers, which the Handler then gets through
+	// IBBHandler, SOCKS5Handler or JingleHandler respectively. Offers are
+	// refused while they are unset, bar the bytestreams our own Jingle
+	// sessions negotiate.
+	AcceptIBB    bool
+	AcceptSOCKS5 bool
+	AcceptJingle bool
+
+	// IBBBlockSize is the block size proposed for in-band bytestreams we
+	// open, and the largest one accepted from peers. Defaults to 4096.
+	IBBBlockSize int
+
+	// SOCKS5Addr is the host:port listened on for direct SOCKS5 bytestream
+	// (XEP-0065) connections, and advertised to peers, so the host must be
+	// reachable by them. Port 0 picks a free port. When empty, only proxies
+	// are offered.
+	SOCKS5Addr string
+	// SOCKS5Proxies replaces the bytestream proxies otherwise discovered on
+	// the server.
+	SOCKS5Proxies []StreamHost
+
+	// OMEMO, when not nil, enables end-to-end encryption of one-to-one chat
+	// messages.
+	OMEMO *OMEMOConfig
 }
 
 // Dial creates a new connection to an XMPP server and authenticates as the
 // given user.
 func Dial(address, user, domain, password, resource string, config *Config) (c *Conn, err error) {
-	c = new(Conn)
-
-	c.RosterIQMap = make(map[string]chan *ClientIQ)
+	if config == nil {
+		config = new(Config)
+	}
+	c = newConn(config)
 
 	var log io.Writer
-	if config != nil && config.Log != nil {
+	if config.Log != nil {
 		log = config.Log
 	}
 
@@ -149,9 +289,135 @@ func Dial(address, user, domain, password, resource string, config *Config) (c *
 		}
 	}
 
+	if config.InitialPresence {
+		if _, err = fmt.Fprintf(c.out, "<presence id='%s'>%s</presence>", c.getId(), c.capsElement()); err != nil {
+			return nil, err
+		}
+	}
+
 	return c, nil
 }
 
+// newConn sets up the state of a Conn that does not depend on the server.
+func newConn(config *Config) *Conn {
+	c := new(Conn)
+	c.lang = config.Lang
+
+	c.RosterIQMap = make(map[string]chan *ClientIQ)
+	c.pendingIQ = make(map[string]chan *ClientIQ)
+	c.iqHandlers = make(map[string]IQHandlerFunc)
+	c.done = make(chan struct{})
+	c.Caps = NewCapsCache(config.CapsStore)
+	c.capsNode = config.CapsNode
+	if c.capsNode == "" {
+		c.capsNode = DefaultCapsNode
+	}
+	c.RegisterFeature(nsCaps)
+
+	c.discoNodes = make(map[string]discoNode)
+	c.identities = config.Identities
+	if len(c.identities) == 0 {
+		c.identities = []DiscoveryIdentity{{Category: "client", Type: "pc", Name: "xmppclient"}}
+	}
+	c.HandleIQ(nsDiscoInfo, "query", c.answerDiscoInfo)
+	c.HandleIQ(nsDiscoItems, "query", c.answerDiscoItems)
+	c.RegisterFeature(nsDiscoInfo)
+	c.RegisterFeature(nsDiscoItems)
+
+	if !config.HideVersion {
+		c.handleVersion(config.Version)
+	}
+
+	c.HandleIQ(nsPing, "ping", func(*ClientIQ) (string, error) { return "", nil })
+	c.RegisterFeature(nsPing)
+	c.sendReceipts = !config.DisableReceipts
+	if c.sendReceipts {
+		c.RegisterFeature(nsReceipts)
+	}
+
+	c.conversations = make(map[string]*conversation)
+	c.mamQueries = make(map[string]*archivePage)
+	c.RegisterFeature(nsMarkers)
+
+	c.RegisterFeature(nsChatStates)
+	c.RegisterFeature(nsSid)
+	c.RegisterFeature(nsCorrect)
+	c.RegisterFeature(nsRetract)
+	c.RegisterFeature(nsReactions)
+	c.RegisterFeature(nsReply)
+	c.RegisterFeature(nsFallback)
+	c.RegisterFeature(nsStyling)
+	c.RegisterFeature(nsXHTMLIM)
+	c.RegisterFeature(nsOOB)
+	c.httpClient = config.HTTPClient
+	if c.httpClient == nil {
+		c.httpClient = http.DefaultClient
+	}
+
+	c.ibbStreams = make(map[string]*IBBStream)
+	c.ibbExpect = make(map[string]chan *IBBStream)
+	c.ibbBlockSize = config.IBBBlockSize
+	if c.ibbBlockSize <= 0 || c.ibbBlockSize > maxIBBBlockSize {
+		c.ibbBlockSize = defaultIBBBlockSize
+	}
+	c.HandleIQ(nsIBB, "open", c.answerIBBOpen)
+	c.HandleIQ(nsIBB, "data", c.answerIBBData)
+	c.HandleIQ(nsIBB, "close", c.answerIBBClose)
+	c.ibbAccept = config.AcceptIBB
+	if c.ibbAccept {
+		c.RegisterFeature(nsIBB)
+	}
+
+	c.s5Addr = config.SOCKS5Addr
+	c.s5Accept = config.AcceptSOCKS5
+	c.s5Pending = make(map[string]chan net.Conn)
+	c.s5Proxies = config.SOCKS5Proxies
+	c.HandleIQ(nsBytestreams, "query", c.answerBytestreams)
+	if c.s5Accept {
+		c.RegisterFeature(nsBytestreams)
+	}
+
+	c.jingleSessions = make(map[string]*JingleSession)
+	c.rooms = make(map[string]bool)
+	c.HandleIQ(nsJingle, "jingle", c.answerJingle)
+	c.jingleAccept = config.AcceptJingle
+	if c.jingleAccept {
+		c.RegisterFeature(nsJingle)
+		c.RegisterFeature(nsJingleFT)
+		c.RegisterFeature(nsJingleIBB)
+		c.RegisterFeature(nsJingleS5B)
+	}
+
+	c.blocked = make(map[string]bool)
+	c.HandleIQ(nsBlocking, "block", c.answerBlockPush)
+	c.HandleIQ(nsBlocking, "unblock", c.answerBlockPush)
+
+	if config.OMEMO != nil {
+		c.omemo = newOMEMO(c, *config.OMEMO)
+		c.RegisterFeature(nodeOMEMODevices + "+notify")
+	}
+	if config.ChatStates != nil {
+		c.chatStates = newChatStateMachine(c, *config.ChatStates)
+	}
+
+	c.keepAlive = config.KeepAlive
+	c.keepAliveMisses = config.KeepAliveMisses
+	if c.keepAliveMisses <= 0 {
+		c.keepAliveMisses = 3
+	}
+
+	// Roster pushes must be acknowledged, see RFC 6121 section 2.1.6, and
+	// ignored unless they come from our account.
+	c.HandleIQ(nsRoster, "query", func(iq *ClientIQ) (string, error) {
+		if !c.isReplyFrom("", iq.From) {
+			return "", NewStanzaError("cancel", "service-unavailable")
+		}
+		return "", nil
+	})
+
+	return c
+}
+
 func startTLSNegotiation(c *Conn, domain string, log io.Writer, config *Config) (conn io.ReadWriter, err error) {
 	c.in, c.out = makeInOut(c.xConn, config)
 
@@ -273,17 +539,23 @@ func certName(cert *x509.Certificate) string {
 	return ret
 }
 
-func (c *Conn) getId() uint64 {
+// getId returns a new unique id for an outgoing stanza. Every stanza we send
+// carries one, and messages also repeat it as their origin-id (XEP-0359).
+func (c *Conn) getId() string {
 	var buf [8]byte
 	if _, err := rand.Reader.Read(buf[:]); err != nil {
 		panic("Failed to read random bytes: " + err.Error())
 	}
-	return binary.LittleEndian.Uint64(buf[:])
+	return fmt.Sprintf("%016x", binary.LittleEndian.Uint64(buf[:]))
 }
 
 // rfc3920 section 5.2
 func (c *Conn) getFeatures(domain string) (features streamFeatures, err error) {
-	if _, err = fmt.Fprintf(c.out, "<?xml version='1.0'?><stream:stream to='%s' xmlns='%s' xmlns:stream='%s' version='1.0'>\n", xmlEscape(domain), nsClient, nsStream); err != nil {
+	lang := ""
+	if c.lang != "" {
+		lang = fmt.Sprintf(" xml:lang='%s'", xmlEscape(c.lang))
+	}
+	if _, err = fmt.Fprintf(c.out, "<?xml version='1.0'?><stream:stream to='%s' xmlns='%s' xmlns:stream='%s' version='1.0'%s>\n", xmlEscape(domain), nsClient, nsStream, lang); err != nil {
 		return
 	}
 
@@ -295,6 +567,11 @@ func (c *Conn) getFeatures(domain string) (features streamFeatures, err error) {
 		err = errors.New("xmpp: expected <stream> but got <" + se.Name.Local + "> in " + se.Name.Space)
 		return
 	}
+	for _, attr := range se.Attr {
+		if attr.Name.Local == "lang" {
+			c.StreamLang = attr.Value
+		}
+	}
 
 	// Now we're in the stream and can use Unmarshal.
 	// Next message should be <features> to tell us authentication options.
@@ -339,25 +616,85 @@ func (c *Conn) Next(ch chan<- Stanza) {
 }
 
 func (c *Conn) Listen() {
+	defer c.closeOnce.Do(func() { close(c.done) })
+	if c.keepAlive > 0 {
+		go c.keepAliveLoop()
+	}
+	if c.omemo != nil {
+		c.omemo.publishLater()
+	}
 	for {
 		stanza, err := new(Stanza), (error)(nil)
 		if stanza.Name, stanza.Value, err = next(c.in); err != nil {
+			c.setErr(err)
 			return
 		}
 		switch stanza.Name.Local {
 		case "presence":
 			presence := stanza.Value.(*ClientPresence)
+			if c.IsBlocked(presence.From) {
+				break
+			}
 			c.OnlineRoster = append(c.OnlineRoster, presence.From)
+			if presence.HasCaps() {
+				c.Caps.setPeer(presence.From, presence.C)
+			} else if presence.IsUnavailable() {
+				c.Caps.setPeer(presence.From, PresenceC{})
+			}
 			if c.Handler != nil {
 				c.Handler.RecvPresence(presence)
 			}
 		case "message":
+			msg := stanza.Value.(*ClientMessage)
+			if c.IsBlocked(msg.From) {
+				break
+			}
+			msg.inheritLang(c.StreamLang)
+			if msg.ArchiveResult != nil && c.deliverArchived(msg) {
+				break
+			}
+			if msg.IBBData != nil {
+				c.recvIBBMessage(msg)
+				break
+			}
+			if c.omemo != nil && msg.Event != nil && msg.Event.Items != nil && msg.Event.Items.Node == nodeOMEMODevices {
+				c.omemo.recvDeviceList(msg)
+				break
+			}
+			if msg.CarbonSent != nil || msg.CarbonReceived != nil {
+				// The wrapper comes from our own account, so the block
+				// applies to the copied message.
+				if msg = c.unwrapCarbon(msg); msg == nil || c.IsBlocked(msg.From) {
+					break
+				}
+			}
+			if c.omemo != nil {
+				if msg.OMEMO != nil {
+					c.omemo.decrypt(msg)
+				}
+				c.omemo.prepareReply(msg)
+			}
+			c.handleReceipts(msg)
+			c.trackMarkable(msg)
 			if c.Handler != nil {
-				c.Handler.RecvMsg(stanza.Value.(*ClientMessage))
+				c.Handler.RecvMsg(msg)
 			}
 		case "iq":
+			iq := stanza.Value.(*ClientIQ)
+			if iq.Type == "get" || iq.Type == "set" {
+				// Blocked entities get no answer revealing we are here,
+				// nor can they offer streams or sessions.
+				if c.IsBlocked(iq.From) {
+					c.sendIQError(iq, NewStanzaError("cancel", "service-unavailable"))
+					break
+				}
+				c.handleIQ(iq)
+				break
+			}
+			if c.deliverIQ(iq) {
+				break
+			}
 			if c.Handler != nil {
-				iq := stanza.Value.(*ClientIQ)
 				if ch, ok := c.RosterIQMap[iq.Id]; ok {
 					ch <- iq
 				}
@@ -368,60 +705,109 @@ func (c *Conn) Listen() {
 
 // Send an IM message to the given user.
 func (c *Conn) Send(to, msg string) error {
-	return c.sendMessage(to, msg, "chat")
+	_, err := c.sendMessage(to, msg, "chat")
+	return err
 }
 
 // Send an Im message to group chat.
 func (c *Conn) SendGroupChatMessage(to, msg string) error {
-	return c.sendMessage(to, msg, "groupchat")
+	_, err := c.sendMessage(to, msg, "groupchat")
+	return err
+}
+
+// SendMessage sends a message of the given type (chat, groupchat, headline
+// or normal) with the extensions added by opts, and returns its id. An empty
+// msg sends no body, for messages that only carry extensions.
+func (c *Conn) SendMessage(to, msg, chatType string, opts ...MessageOption) (id string, err error) {
+	return c.sendMessage(to, msg, chatType, opts...)
 }
 
-func (c *Conn) sendMessage(to, msg, chatType string) error {
+func (c *Conn) sendMessage(to, msg, chatType string, opts ...MessageOption) (string, error) {
+	m := &outgoingMessage{id: c.getId(), body: msg}
+	for _, opt := range opts {
+		opt(m)
+	}
+	body := ""
+	if m.body != "" {
+		body = "<body>" + xmlEscape(m.body) + "</body>"
+	}
+	if chatType == "chat" && c.omemo != nil && (m.body != "" || m.content) {
+		encrypted, err := c.omemo.encrypt(to, m.body, m.content)
+		if err != nil {
+			return "", err
+		}
+		if encrypted != "" {
+			body = encrypted
+		}
+	}
+	if m.body != "" && chatType == "chat" && c.chatStates != nil {
+		c.chatStates.sending(to, m)
+	}
 	_, err := fmt.Fprintf(
 		c.out,
-		"<message to='%s' from='%s' type='%s'><body>%s</body></message>",
+		"<message to='%s' from='%s' type='%s' id='%s'>%s<origin-id xmlns='%s' id='%s'/>%s</message>",
 		xmlEscape(to),
 		xmlEscape(c.Jid),
 		chatType,
-		xmlEscape(msg),
+		m.id,
+		body,
+		nsSid,
+		m.id,
+		m.extensions.String(),
 	)
-	return err
+	return m.id, err
 }
 
-// Send sends an IM message to the given user.
+// SendComposing tells the given user we are typing a message.
 func (c *Conn) SendComposing(to string) error {
-	_, err := fmt.Fprintf(
-		c.out,
-		"<message to='%s' from='%s' type='chat'><composing xmlns='http://jabber.org/protocol/chatstates'/></message>",
-		xmlEscape(to),
-		xmlEscape(c.Jid),
-	)
-	return err
+	return c.sendChatState(to, ChatStateComposing)
 }
 
-// Send sends an IM message to the given user.
+// SendActive tells the given user we are paying attention to the chat.
 func (c *Conn) SendActive(to string) error {
+	return c.sendChatState(to, ChatStateActive)
+}
+
+// SendPaused tells the given user we stopped typing.
+func (c *Conn) SendPaused(to string) error {
+	return c.sendChatState(to, ChatStatePaused)
+}
+
+// SendInactive tells the given user we are not paying attention to the chat.
+func (c *Conn) SendInactive(to string) error {
+	return c.sendChatState(to, ChatStateInactive)
+}
+
+// SendGone tells the given user we left the chat.
+func (c *Conn) SendGone(to string) error {
+	return c.sendChatState(to, ChatStateGone)
+}
+
+func (c *Conn) sendChatState(to, state string) error {
 	_, err := fmt.Fprintf(
 		c.out,
-		"<message to='%s' from='%s' type='chat'><active xmlns='http://jabber.org/protocol/chatstates'/></message>",
+		"<message to='%s' from='%s' type='chat' id='%s'><%s xmlns='%s'/></message>",
 		xmlEscape(to),
 		xmlEscape(c.Jid),
+		c.getId(),
+		state,
+		nsChatStates,
 	)
 	return err
 }
 
 func (c *Conn) SignalPresence(state string) error {
-	_, err := fmt.Fprintf(c.out, "<presence><show>%s</show></presence>", xmlEscape(state))
+	_, err := fmt.Fprintf(c.out, "<presence id='%s'><show>%s</show>%s</presence>", c.getId(), xmlEscape(state), c.capsElement())
 	return err
 }
 
 func (c *Conn) SetOffLine() error {
-	_, err := fmt.Fprintf(c.out, `<presence type="unavailable"><show>0</show></presence>`)
+	_, err := fmt.Fprintf(c.out, `<presence type="unavailable" id="%s"><show>0</show></presence>`, c.getId())
 	return err
 }
 
 func (c *Conn) SliencePresence() error {
-	_, err := fmt.Fprintf(c.out, "<presence><priority>-1</priority></presence>")
+	_, err := fmt.Fprintf(c.out, "<presence id='%s'><priority>-1</priority>%s</presence>", c.getId(), c.capsElement())
 	return err
 }
 
@@ -431,18 +817,21 @@ func (c *Conn) PresenceMuc(to string, isJoined bool) (err error) {
 	}
 	_, err = fmt.Fprintf(
 		c.out,
-		"<presence to='%s' from='%s' type='unavailable'/>",
+		"<presence to='%s' from='%s' type='unavailable' id='%s'/>",
 		xmlEscape(to),
 		xmlEscape(c.Jid),
+		c.getId(),
 	)
 	return
 
 joined:
 	_, err = fmt.Fprintf(
 		c.out,
-		"<presence to='%s' from='%s'><x xmlns='http://jabber.org/protocol/muc'/></presence>",
+		"<presence to='%s' from='%s' id='%s'><x xmlns='http://jabber.org/protocol/muc'/>%s</presence>",
 		xmlEscape(to),
 		xmlEscape(c.Jid),
+		c.getId(),
+		c.capsElement(),
 	)
 	return
 }
@@ -451,6 +840,27 @@ func (c *Conn) Close() (err error) {
 	return c.xConn.Close()
 }
 
+// Done is closed once Listen has stopped reading from the connection.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why Listen stopped. It is nil until Done is closed.
+func (c *Conn) Err() error {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	return c.err
+}
+
+// setErr records the first reason the connection stopped.
+func (c *Conn) setErr(err error) {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+}
+
 // rfc6121
 // http://www.rfc-editor.org/rfc/rfc6121.txt
 //<iq from='juliet@example.com/balcony'
@@ -462,16 +872,15 @@ func (c *Conn) RetrieveRoster() (err error) {
 	id := c.getId()
 	_, err = fmt.Fprintf(
 		c.out,
-		"<iq from='%s' id='%d' type='get'><query xmlns='%s'></query></iq>",
-		//"<iq from='%s' id='%d' type='get'><query xmlns='%s'/></iq>",
+		"<iq from='%s' id='%s' type='get'><query xmlns='%s'></query></iq>",
+		//"<iq from='%s' id='%s' type='get'><query xmlns='%s'/></iq>",
 		xmlEscape(c.Jid),
 		//c.getId(),
 		id,
 		nsRoster,
 	)
-	idStr := fmt.Sprintf("%d", id)
-	c.RosterIQMap[idStr] = make(chan *ClientIQ)
-	iq := <-c.RosterIQMap[idStr]
+	c.RosterIQMap[id] = make(chan *ClientIQ)
+	iq := <-c.RosterIQMap[id]
 	log.Println(iq)
 	//TODO paser the roster items
 	return
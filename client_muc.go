@@ -1,6 +1,9 @@
 package xmppclient
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+)
 
 const (
 	AffiliationNone    int = 1
@@ -27,15 +30,29 @@ func (c *Conn) CreateRoom(jid string) {
 func (c *Conn) JoinMUC(jid string, nickname string) error {
 	_, err := fmt.Fprintf(
 		c.out,
-		"<presence from='%s' to='%s/%s'><x xmlns='%s'/></presence>",
+		"<presence from='%s' to='%s/%s' id='%s'><x xmlns='%s'/>%s</presence>",
 		xmlEscape(c.Jid),
 		xmlEscape(jid),
 		xmlEscape(nickname),
+		c.getId(),
 		nsMuc,
+		c.capsElement(),
 	)
+	if err == nil {
+		c.roomsMu.Lock()
+		c.rooms[RemoveResourceFromJid(jid)] = true
+		c.roomsMu.Unlock()
+	}
 	return err
 }
 
+// isRoom tells whether jid is a room we joined or one of its occupants.
+func (c *Conn) isRoom(jid string) bool {
+	c.roomsMu.Lock()
+	defer c.roomsMu.Unlock()
+	return c.rooms[RemoveResourceFromJid(jid)]
+}
+
 //<message
 //    from='crone1@shakespeare.lit/desktop'
 //    id='nzd143v8'
@@ -77,9 +94,10 @@ func (c *Conn) SendMediatedMucInvitation(to string, roomJid string, reason strin
 func (c *Conn) SendDirectMucInvitation(to string, roomJid string, reason string) error {
 	_, err := fmt.Fprintf(
 		c.out,
-		"<message to='%s' from='%s'><x xmlns='%s' jid='%s' reason='%s'/></message>",
+		"<message to='%s' from='%s' id='%s'><x xmlns='%s' jid='%s' reason='%s'/></message>",
 		xmlEscape(to),
 		xmlEscape(c.Jid),
+		c.getId(),
 		nsConference,
 		xmlEscape(roomJid),
 		reason,
@@ -88,7 +106,7 @@ func (c *Conn) SendDirectMucInvitation(to string, roomJid string, reason string)
 }
 
 func (c *Conn) DestroyRoom(jid string) error {
-	_, err := fmt.Fprintf(c.out, "<iq from='%s' id='%x' to='%s' type='set'><query xmlns='%s'><destroy jid='%s'></destroy></query></iq>",
+	_, err := fmt.Fprintf(c.out, "<iq from='%s' id='%s' to='%s' type='set'><query xmlns='%s'><destroy jid='%s'></destroy></query></iq>",
 		c.Jid, c.getId(), jid, nsMucAdmin, jid)
 	return err
 }
@@ -99,25 +117,8 @@ func (c *Conn) DestroyRoom(jid string) error {
 //     type='get'>
 //   <query xmlns='http://jabber.org/protocol/disco#items'/>
 // </iq>
-func (c *Conn) DiscoverRooms() {
-	fmt.Fprintf(
-		c.out,
-		"<iq type='get' from='%s' to='conference.localhost'><query xmlns='http://jabber.org/protocol/disco#items'/></iq>",
-		c.escapedJid,
-		// c.escapedDomain,
-	)
-
-	for {
-		// token, err2 := c.in.Token()
-		// fmt.Printf("%+v\n", token)
-		// fmt.Printf("%+v\n", err2)
-
-		iq := ClientIQ{}
-		if err := c.in.DecodeElement(&iq, nil); err != nil {
-			fmt.Printf("error %+v\n", err)
-		}
-		fmt.Printf("Query: %+v\n", string(iq.Query))
-	}
+func (c *Conn) DiscoverRooms(ctx context.Context, service string) ([]DiscoveryItem, error) {
+	return c.DiscoItems(ctx, service, "")
 }
 
 func (c *Conn) SetRole(roomJid, jid string, role int) error {
@@ -137,7 +138,7 @@ func (c *Conn) SetRole(roomJid, jid string, role int) error {
 	cookie := c.getId()
 	_, err := fmt.Fprintf(
 		c.out,
-		"<iq from='%s' id='%x' to='%s' type='set'><query xmlns='%s'><item jid='%s' role='%s'/></query></iq>",
+		"<iq from='%s' id='%s' to='%s' type='set'><query xmlns='%s'><item jid='%s' role='%s'/></query></iq>",
 		xmlEscape(c.Jid),
 		cookie,
 		xmlEscape(roomJid),
@@ -167,7 +168,7 @@ func (c *Conn) SetAffiliation(roomJid, jid string, affiliation int) error {
 	cookie := c.getId()
 	_, err := fmt.Fprintf(
 		c.out,
-		"<iq from='%s' id='%x' to='%s' type='set'><query xmlns='%s'><item affiliation='%s' jid='%s'/></query></iq>",
+		"<iq from='%s' id='%s' to='%s' type='set'><query xmlns='%s'><item affiliation='%s' jid='%s'/></query></iq>",
 		xmlEscape(c.Jid),
 		cookie,
 		xmlEscape(roomJid),
@@ -0,0 +1,120 @@
+package xmppclient
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net"
+	"testing"
+)
+
+// fakeServer is the server end of a Conn talking over a pipe, with the
+// stream already opened.
+type fakeServer struct {
+	c   *Conn
+	srv net.Conn
+	dec *xml.Decoder
+}
+
+// newFakeServer returns the server end of a new connection of jid, a JID at
+// example.com.
+func newFakeServer(t *testing.T, config *Config, jid string) *fakeServer {
+	if config == nil {
+		config = new(Config)
+	}
+	client, srv := net.Pipe()
+	c := newConn(config)
+	c.xConn = client
+	c.rawOut = client
+	c.in, c.out = makeInOut(client, config)
+	c.Jid = jid
+	c.Domain = "example.com"
+	t.Cleanup(func() {
+		srv.Close()
+		client.Close()
+	})
+
+	go srv.Write([]byte("<stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams'>"))
+	if _, err := nextStart(c.in); err != nil {
+		t.Fatal(err)
+	}
+	return &fakeServer{c: c, srv: srv, dec: xml.NewDecoder(srv)}
+}
+
+// next returns the next stanza written by the client and its inner XML.
+func (f *fakeServer) next() (xml.StartElement, string, error) {
+	for {
+		tok, err := f.dec.Token()
+		if err != nil {
+			return xml.StartElement{}, "", err
+		}
+		se, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		var raw struct {
+			Inner string `xml:",innerxml"`
+		}
+		err = f.dec.DecodeElement(&raw, &se)
+		return se, raw.Inner, err
+	}
+}
+
+// routeFunc may answer a stanza sent by from in place of the peer, returning
+// true when it did.
+type routeFunc func(from *fakeServer, stanza xml.StartElement, inner string) bool
+
+// link returns two connections, a@example.com/r and b@example.com/r, whose
+// stanzas are delivered to each other stamped with the sender. Stanzas route
+// does not answer go to the peer whatever their address. Listen is left to
+// the caller, so that handlers can be set first.
+func link(t *testing.T, configA, configB *Config, route routeFunc) (a, b *fakeServer) {
+	a = newFakeServer(t, configA, "a@example.com/r")
+	b = newFakeServer(t, configB, "b@example.com/r")
+	forward := func(from, to *fakeServer) {
+		for {
+			se, inner, err := from.next()
+			if err != nil {
+				return
+			}
+			if route != nil && route(from, se, inner) {
+				continue
+			}
+			if to.deliver(from, se, inner) != nil {
+				return
+			}
+		}
+	}
+	go forward(a, b)
+	go forward(b, a)
+	return a, b
+}
+
+// deliver writes a stanza sent by from to the client, stamped with its
+// sender.
+func (f *fakeServer) deliver(from *fakeServer, stanza xml.StartElement, inner string) error {
+	var buf bytes.Buffer
+	buf.WriteString("<" + stanza.Name.Local)
+	for _, a := range stanza.Attr {
+		if a.Name.Local == "from" || a.Name.Local == "xmlns" || a.Name.Space == "xmlns" {
+			continue
+		}
+		buf.WriteString(" " + a.Name.Local + "='" + xmlEscape(a.Value) + "'")
+	}
+	buf.WriteString(" from='" + xmlEscape(from.c.Jid) + "'>" + inner + "</" + stanza.Name.Local + ">")
+	_, err := f.srv.Write(buf.Bytes())
+	return err
+}
+
+// reply answers the IQ stanza from the address it was sent to.
+func (f *fakeServer) reply(stanza xml.StartElement, payload string) {
+	go f.srv.Write([]byte("<iq type='result' id='" + xmlEscape(attr(stanza, "id")) + "' from='" + xmlEscape(attr(stanza, "to")) + "'>" + payload + "</iq>"))
+}
+
+func attr(se xml.StartElement, name string) string {
+	for _, a := range se.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,43 @@
+package xmppclient
+
+import "fmt"
+
+// Last Message Correction, XEP-0308
+// http://xmpp.org/extensions/xep-0308.html
+
+// Correct replaces the body of the chat message originalID previously sent
+// to the given user with newBody, and returns the id of the correction. When
+// correcting a correction, originalID is still the id of the first message.
+//
+//	<message to='juliet@capulet.net/balcony' id='good1'>
+//	  <body>But soft, what light through yonder window breaks?</body>
+//	  <replace id='bad1' xmlns='urn:xmpp:message-correct:0'/>
+//	</message>
+func (c *Conn) Correct(to, originalID, newBody string) (string, error) {
+	return c.sendMessage(to, newBody, "chat", Replaces(originalID))
+}
+
+// Replaces marks the message as the correction of the message id, for use
+// with SendMessage, e.g. to correct groupchat messages.
+func Replaces(id string) MessageOption {
+	return func(m *outgoingMessage) {
+		fmt.Fprintf(&m.extensions, "<replace xmlns='%s' id='%s'/>", nsCorrect, xmlEscape(id))
+	}
+}
+
+// IsValidCorrection reports whether correction may replace original: it must
+// refer to original and come from the same sender. In groupchat that is the
+// same occupant; otherwise the same account, since the sender may have
+// reconnected with another resource in between.
+func IsValidCorrection(original, correction *ClientMessage) bool {
+	if correction.Replace == nil {
+		return false
+	}
+	if id := correction.Replace.Id; id != original.Id && id != original.OriginalId() {
+		return false
+	}
+	if original.Type == "groupchat" || correction.Type == "groupchat" {
+		return original.Type == correction.Type && original.From == correction.From
+	}
+	return RemoveResourceFromJid(original.From) == RemoveResourceFromJid(correction.From)
+}
@@ -0,0 +1,27 @@
+package xmppclient
+
+import (
+	"fmt"
+	"time"
+)
+
+// Delayed Delivery, XEP-0203
+// http://xmpp.org/extensions/xep-0203.html
+
+// WithDelay marks a message as originally sent at stamp, for relaying
+// historical messages. from is the JID of the entity that delayed the
+// message, usually our own, and may be empty.
+//
+//	<message from='romeo@montague.net/orchard' to='juliet@capulet.com' type='chat'>
+//	  <body>O blessed, blessed night! I am afeard.</body>
+//	  <delay xmlns='urn:xmpp:delay' from='capulet.com' stamp='2002-09-10T23:08:25Z'/>
+//	</message>
+func WithDelay(stamp time.Time, from string) MessageOption {
+	return func(m *outgoingMessage) {
+		fromAttr := ""
+		if from != "" {
+			fromAttr = fmt.Sprintf(" from='%s'", xmlEscape(from))
+		}
+		fmt.Fprintf(&m.extensions, "<delay xmlns='%s'%s stamp='%s'/>", nsDelay, fromAttr, stamp.UTC().Format(time.RFC3339))
+	}
+}
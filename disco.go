@@ -0,0 +1,156 @@
+package xmppclient
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+)
+
+// Service Discovery, XEP-0030
+// http://xmpp.org/extensions/xep-0030.html
+
+// DiscoInfo asks jid for its identities, features and extended information.
+// node may be empty to query the entity itself.
+//
+//	<iq type='get' to='plays.shakespeare.lit' id='info1'>
+//	  <query xmlns='http://jabber.org/protocol/disco#info'/>
+//	</iq>
+func (c *Conn) DiscoInfo(ctx context.Context, jid, node string) (*DiscoveryReply, error) {
+	iq, err := c.sendIQ(ctx, jid, "get", discoQuery(nsDiscoInfo, node))
+	if err != nil {
+		return nil, err
+	}
+	reply := new(DiscoveryReply)
+	if err = unmarshalQuery(iq, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// DiscoItems asks jid for the items associated with it, such as the rooms
+// of a MUC service. node may be empty to query the entity itself.
+//
+//	<iq type='get' to='shakespeare.lit' id='items1'>
+//	  <query xmlns='http://jabber.org/protocol/disco#items'/>
+//	</iq>
+func (c *Conn) DiscoItems(ctx context.Context, jid, node string) ([]DiscoveryItem, error) {
+	iq, err := c.sendIQ(ctx, jid, "get", discoQuery(nsDiscoItems, node))
+	if err != nil {
+		return nil, err
+	}
+	var reply DiscoveryItems
+	if err = unmarshalQuery(iq, &reply); err != nil {
+		return nil, err
+	}
+	return reply.Items, nil
+}
+
+func discoQuery(ns, node string) string {
+	if node == "" {
+		return fmt.Sprintf("<query xmlns='%s'/>", ns)
+	}
+	return fmt.Sprintf("<query xmlns='%s' node='%s'/>", ns, xmlEscape(node))
+}
+
+type discoNode struct {
+	info  *DiscoveryReply
+	items []DiscoveryItem
+}
+
+// RegisterFeature adds v to the features answered to disco#info queries and
+// hashed into our caps. Extensions register their namespace when enabled;
+// applications may add their own. Presence sent afterwards carries the new
+// caps verification string.
+func (c *Conn) RegisterFeature(v string) {
+	c.discoMu.Lock()
+	defer c.discoMu.Unlock()
+	for _, f := range c.features {
+		if f == v {
+			return
+		}
+	}
+	c.features = append(c.features, v)
+}
+
+// UnregisterFeature removes v from the advertised features.
+func (c *Conn) UnregisterFeature(v string) {
+	c.discoMu.Lock()
+	defer c.discoMu.Unlock()
+	for i, f := range c.features {
+		if f == v {
+			c.features = append(c.features[:i], c.features[i+1:]...)
+			return
+		}
+	}
+}
+
+// RegisterIdentity adds an identity to the ones answered to disco#info
+// queries.
+func (c *Conn) RegisterIdentity(id DiscoveryIdentity) {
+	c.discoMu.Lock()
+	defer c.discoMu.Unlock()
+	c.identities = append(c.identities, id)
+}
+
+// RegisterDiscoNode publishes info and items under node. info may be nil for
+// nodes that only hold items. Items registered under the empty node are
+// answered to disco#items queries on the client itself.
+func (c *Conn) RegisterDiscoNode(node string, info *DiscoveryReply, items []DiscoveryItem) {
+	c.discoMu.Lock()
+	defer c.discoMu.Unlock()
+	c.discoNodes[node] = discoNode{info: info, items: items}
+}
+
+// discoInfo describes this client, as answered to disco#info queries and
+// hashed into our own caps.
+func (c *Conn) discoInfo() *DiscoveryReply {
+	c.discoMu.RLock()
+	defer c.discoMu.RUnlock()
+	info := &DiscoveryReply{Identities: append([]DiscoveryIdentity(nil), c.identities...)}
+	for _, f := range c.features {
+		info.Features = append(info.Features, DiscoveryFeature{Var: f})
+	}
+	return info
+}
+
+func (c *Conn) answerDiscoInfo(iq *ClientIQ) (string, error) {
+	var query DiscoveryReply
+	if err := xml.Unmarshal(iq.Query, &query); err != nil {
+		return "", NewStanzaError("modify", "bad-request")
+	}
+
+	var info *DiscoveryReply
+	switch query.Node {
+	case "", c.capsNode + "#" + c.CapsVer():
+		info = c.discoInfo()
+	default:
+		c.discoMu.RLock()
+		info = c.discoNodes[query.Node].info
+		c.discoMu.RUnlock()
+		if info == nil {
+			return "", NewStanzaError("cancel", "item-not-found")
+		}
+	}
+
+	reply := *info
+	reply.Node = query.Node
+	out, err := xml.Marshal(reply)
+	return string(out), err
+}
+
+func (c *Conn) answerDiscoItems(iq *ClientIQ) (string, error) {
+	var query DiscoveryItems
+	if err := xml.Unmarshal(iq.Query, &query); err != nil {
+		return "", NewStanzaError("modify", "bad-request")
+	}
+
+	c.discoMu.RLock()
+	node, ok := c.discoNodes[query.Node]
+	c.discoMu.RUnlock()
+	if !ok && query.Node != "" {
+		return "", NewStanzaError("cancel", "item-not-found")
+	}
+
+	out, err := xml.Marshal(DiscoveryItems{Node: query.Node, Items: node.items})
+	return string(out), err
+}
@@ -50,7 +50,7 @@ func main() {
 	fmt.Println("done")
 
 	//conn.Send("jiangnan34-theplant@localhost", "it's my message.")
-	// conn.DiscoverRooms()
+	// conn.DiscoverRooms(context.Background(), "conference.localhost")
 	// for {
 	// 	msg := <-conn.Message
 	// 	log.Printf("--> %+v\n", msg.Body)
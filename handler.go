@@ -2,6 +2,9 @@ package xmppclient
 
 import "fmt"
 
+// Handler receives the stanzas read by Listen, on the goroutine running it.
+// Its methods must not call anything that waits for a reply, such as
+// DiscoInfo or Ping, as replies are only read once they return.
 type Handler interface {
 	RecvMsg(msg *ClientMessage)
 	RecvPresence(pres *ClientPresence)
@@ -18,3 +21,36 @@ func (b *BasicHandler) RecvPresence(pres *ClientPresence) {
 	fmt.Println(pres)
 	return
 }
+
+// ReceiptHandler is implemented by a Handler that wants to know when messages
+// sent with RequestReceipt reach the recipient (XEP-0184).
+type ReceiptHandler interface {
+	RecvReceipt(from, id string)
+}
+
+// IBBHandler is implemented by a Handler that accepts in-band bytestreams
+// (XEP-0047) opened by peers, when Config.AcceptIBB is set. AcceptIBB runs on
+// the goroutine calling Listen, so it must hand the stream to another
+// goroutine rather than use it directly. Returning false rejects the stream.
+type IBBHandler interface {
+	AcceptIBB(s *IBBStream) bool
+}
+
+// SOCKS5Handler is implemented by a Handler that accepts SOCKS5 bytestreams
+// (XEP-0065) offered by peers, when Config.AcceptSOCKS5 is set. AcceptSOCKS5
+// runs on the goroutine calling Listen and decides whether to connect to the
+// stream hosts peer offers for the stream sid; nothing is dialed unless it
+// returns true. RecvSOCKS5 then gets the stream once connected, on a
+// goroutine of its own.
+type SOCKS5Handler interface {
+	AcceptSOCKS5(peer, sid string) bool
+	RecvSOCKS5(s *SOCKS5Stream)
+}
+
+// JingleHandler is implemented by a Handler that accepts files offered over
+// Jingle (XEP-0234). RecvFileOffer runs on the goroutine calling Listen, so it
+// must hand the offer to another goroutine to Accept or Decline it. Offers
+// only reach it when Config.AcceptJingle is set.
+type JingleHandler interface {
+	RecvFileOffer(o *FileOffer)
+}
@@ -0,0 +1,39 @@
+package xmppclient
+
+// Message Processing Hints, XEP-0334
+// http://xmpp.org/extensions/xep-0334.html
+
+// NoStore asks servers not to store the message at all, neither in archives
+// nor for delivery once the recipient comes online.
+//
+//	<message to='juliet@capulet.lit/laptop' type='chat'>
+//	  <body>V unir avtug'f pybnx gb uvqr zr sebz gurve fvtug</body>
+//	  <no-store xmlns='urn:xmpp:hints'/>
+//	</message>
+func NoStore() MessageOption {
+	return hint("no-store")
+}
+
+// NoPermanentStore asks servers not to archive the message. It may still be
+// stored for offline delivery.
+func NoPermanentStore() MessageOption {
+	return hint("no-permanent-store")
+}
+
+// NoCopy asks servers not to copy the message to other resources, such as
+// with message carbons.
+func NoCopy() MessageOption {
+	return hint("no-copy")
+}
+
+// Store asks servers to store the message even though it has no body, e.g.
+// for a message carrying only an extension.
+func Store() MessageOption {
+	return hint("store")
+}
+
+func hint(name string) MessageOption {
+	return func(m *outgoingMessage) {
+		m.extensions.WriteString("<" + name + " xmlns='" + nsHints + "'/>")
+	}
+}
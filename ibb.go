@@ -0,0 +1,401 @@
+package xmppclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// In-Band Bytestreams, XEP-0047
+// http://xmpp.org/extensions/xep-0047.html
+
+// The stanzas an in-band bytestream can carry its data in.
+const (
+	IBBStanzaIQ      = "iq"
+	IBBStanzaMessage = "message"
+)
+
+const (
+	defaultIBBBlockSize = 4096
+	maxIBBBlockSize     = 65535
+	// Opening gives up rather than halve the block size below this.
+	minIBBBlockSize = 256
+	// Streams whose reader falls this many blocks behind are closed.
+	maxIBBBufferedBlocks = 16
+)
+
+// IBBStream is an in-band bytestream with a peer. Data is base64 encoded and
+// sent in blocks of at most BlockSize bytes. In IQ mode every block is
+// acknowledged, so Write must not be called from the goroutine running
+// Listen. Received data is buffered until read; a peer sending more than a
+// few blocks ahead of the reader gets the stream closed.
+type IBBStream struct {
+	c         *Conn
+	peer      string
+	sid       string
+	blockSize int
+	stanza    string
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	buf     bytes.Buffer
+	inSeq   uint16
+	readErr error
+
+	writeMu  sync.Mutex
+	outSeq   uint16
+	writeErr error
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (c *Conn) newIBBStream(peer, sid string, blockSize int, stanza string) *IBBStream {
+	s := &IBBStream{
+		c:         c,
+		peer:      peer,
+		sid:       sid,
+		blockSize: blockSize,
+		stanza:    stanza,
+		closed:    make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	go func() {
+		select {
+		case <-c.done:
+			s.fail(ErrClosed)
+		case <-s.closed:
+		}
+	}()
+	return s
+}
+
+// Peer returns the JID at the other end of the stream.
+func (s *IBBStream) Peer() string { return s.peer }
+
+// Sid returns the stream id.
+func (s *IBBStream) Sid() string { return s.sid }
+
+// BlockSize returns the largest number of bytes sent in a single stanza.
+func (s *IBBStream) BlockSize() int { return s.blockSize }
+
+// OpenIBB opens an in-band bytestream to the full JID to, carrying data in
+// stanza (IBBStanzaIQ or IBBStanzaMessage). The configured block size is
+// halved for as long as the peer answers that it is too large.
+//
+//	<iq from='romeo@montague.net/orchard' id='jn3h8g65' to='juliet@capulet.com/balcony' type='set'>
+//	  <open xmlns='http://jabber.org/protocol/ibb' block-size='4096' sid='i781hf64' stanza='iq'/>
+//	</iq>
+func (c *Conn) OpenIBB(ctx context.Context, to, stanza string) (*IBBStream, error) {
+	return c.openIBB(ctx, to, c.getId(), stanza, c.ibbBlockSize)
+}
+
+func (c *Conn) openIBB(ctx context.Context, to, sid, stanza string, blockSize int) (*IBBStream, error) {
+	if stanza != IBBStanzaIQ && stanza != IBBStanzaMessage {
+		return nil, errors.New("xmpp: unknown IBB stanza " + stanza)
+	}
+
+	for ; ; blockSize /= 2 {
+		// Register before asking, as the peer may start sending as soon as
+		// it accepts.
+		s := c.newIBBStream(to, sid, blockSize, stanza)
+		if !c.addIBBStream(s) {
+			return nil, errors.New("xmpp: IBB session " + sid + " already open")
+		}
+
+		_, err := c.sendIQ(ctx, to, "set", fmt.Sprintf(
+			"<open xmlns='%s' block-size='%d' sid='%s' stanza='%s'/>",
+			nsIBB,
+			blockSize,
+			xmlEscape(sid),
+			stanza,
+		))
+		if err == nil {
+			return s, nil
+		}
+		c.removeIBBStream(s)
+		s.fail(err)
+
+		if e, ok := err.(*ClientError); !ok || e.Any.Local != "resource-constraint" || blockSize/2 < minIBBBlockSize {
+			return nil, err
+		}
+	}
+}
+
+func ibbKey(peer, sid string) string {
+	return peer + " " + sid
+}
+
+func (c *Conn) addIBBStream(s *IBBStream) bool {
+	c.ibbMu.Lock()
+	defer c.ibbMu.Unlock()
+	key := ibbKey(s.peer, s.sid)
+	if _, ok := c.ibbStreams[key]; ok {
+		return false
+	}
+	c.ibbStreams[key] = s
+	return true
+}
+
+func (c *Conn) removeIBBStream(s *IBBStream) {
+	c.ibbMu.Lock()
+	defer c.ibbMu.Unlock()
+	key := ibbKey(s.peer, s.sid)
+	if c.ibbStreams[key] == s {
+		delete(c.ibbStreams, key)
+	}
+}
+
+// expectIBB arranges for the stream sid that peer is about to open to be
+// sent on the returned channel rather than offered to the Handler, as
+// negotiated by Jingle. cancel stops waiting for it.
+func (c *Conn) expectIBB(peer, sid string) (ch chan *IBBStream, cancel func()) {
+	key := ibbKey(peer, sid)
+	ch = make(chan *IBBStream, 1)
+	c.ibbMu.Lock()
+	c.ibbExpect[key] = ch
+	c.ibbMu.Unlock()
+	return ch, func() {
+		c.ibbMu.Lock()
+		if c.ibbExpect[key] == ch {
+			delete(c.ibbExpect, key)
+		}
+		c.ibbMu.Unlock()
+	}
+}
+
+func (c *Conn) ibbStream(peer, sid string) *IBBStream {
+	c.ibbMu.Lock()
+	defer c.ibbMu.Unlock()
+	return c.ibbStreams[ibbKey(peer, sid)]
+}
+
+// answerIBBOpen hands a stream opened by a peer to the Jingle session
+// expecting it, or else offers it to the Handler if Config.AcceptIBB is set.
+func (c *Conn) answerIBBOpen(iq *ClientIQ) (string, error) {
+	var open IBBOpen
+	if err := xml.Unmarshal(iq.Query, &open); err != nil || open.Sid == "" || open.BlockSize <= 0 {
+		return "", NewStanzaError("modify", "bad-request")
+	}
+	if open.Stanza == "" {
+		open.Stanza = IBBStanzaIQ
+	}
+	if open.Stanza != IBBStanzaIQ && open.Stanza != IBBStanzaMessage {
+		return "", NewStanzaError("modify", "bad-request")
+	}
+	if open.BlockSize > c.ibbBlockSize {
+		return "", NewStanzaError("modify", "resource-constraint")
+	}
+
+	c.ibbMu.Lock()
+	expected, isExpected := c.ibbExpect[ibbKey(iq.From, open.Sid)]
+	delete(c.ibbExpect, ibbKey(iq.From, open.Sid))
+	c.ibbMu.Unlock()
+
+	if !isExpected && !c.ibbAccept {
+		return "", NewStanzaError("cancel", "service-unavailable")
+	}
+	h, ok := c.Handler.(IBBHandler)
+	if !ok && !isExpected {
+		return "", NewStanzaError("cancel", "not-acceptable")
+	}
+	s := c.newIBBStream(iq.From, open.Sid, open.BlockSize, open.Stanza)
+	if !c.addIBBStream(s) {
+		return "", NewStanzaError("cancel", "not-acceptable")
+	}
+	if isExpected {
+		expected <- s
+		return "", nil
+	}
+	if !h.AcceptIBB(s) {
+		c.removeIBBStream(s)
+		s.fail(io.ErrClosedPipe)
+		return "", NewStanzaError("cancel", "not-acceptable")
+	}
+	return "", nil
+}
+
+// answerIBBData receives a block sent in IQ mode.
+//
+//	<iq from='romeo@montague.net/orchard' id='kr91n475' to='juliet@capulet.com/balcony' type='set'>
+//	  <data xmlns='http://jabber.org/protocol/ibb' seq='0' sid='i781hf64'>qANQR1DBwU4DX7jmYZnncm...</data>
+//	</iq>
+func (c *Conn) answerIBBData(iq *ClientIQ) (string, error) {
+	var data IBBData
+	if err := xml.Unmarshal(iq.Query, &data); err != nil {
+		return "", NewStanzaError("modify", "bad-request")
+	}
+	s := c.ibbStream(iq.From, data.Sid)
+	if s == nil {
+		return "", NewStanzaError("cancel", "item-not-found")
+	}
+	if err := s.recv(&data); err != nil {
+		return "", err
+	}
+	return "", nil
+}
+
+// recvIBBMessage receives a block sent in message mode. Errors cannot be
+// reported back, so the stream is closed instead.
+func (c *Conn) recvIBBMessage(msg *ClientMessage) {
+	s := c.ibbStream(msg.From, msg.IBBData.Sid)
+	if s == nil {
+		return
+	}
+	if s.stanza != IBBStanzaMessage {
+		return
+	}
+	if err := s.recv(msg.IBBData); err != nil {
+		go s.Close()
+	}
+}
+
+func (c *Conn) answerIBBClose(iq *ClientIQ) (string, error) {
+	var cl IBBClose
+	if err := xml.Unmarshal(iq.Query, &cl); err != nil {
+		return "", NewStanzaError("modify", "bad-request")
+	}
+	s := c.ibbStream(iq.From, cl.Sid)
+	if s == nil {
+		return "", NewStanzaError("cancel", "item-not-found")
+	}
+	c.removeIBBStream(s)
+	s.fail(io.EOF)
+	return "", nil
+}
+
+// recv checks the sequence number and size of a block and queues its data
+// for Read. A block out of sequence, or without a valid one, ends the stream,
+// as data has been lost.
+func (s *IBBStream) recv(data *IBBData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.readErr != nil {
+		return NewStanzaError("cancel", "item-not-found")
+	}
+	seq, err := strconv.ParseUint(data.Seq, 10, 16)
+	if err != nil || uint16(seq) != s.inSeq {
+		s.readErr = errors.New("xmpp: IBB block out of sequence")
+		s.cond.Broadcast()
+		s.c.removeIBBStream(s)
+		if err != nil {
+			return NewStanzaError("modify", "bad-request")
+		}
+		return NewStanzaError("cancel", "unexpected-request")
+	}
+	b, err := base64.StdEncoding.DecodeString(data.Data)
+	if err != nil || len(b) > s.blockSize {
+		return NewStanzaError("modify", "bad-request")
+	}
+	if s.buf.Len()+len(b) > maxIBBBufferedBlocks*s.blockSize {
+		s.readErr = errors.New("xmpp: IBB stream not read fast enough")
+		s.cond.Broadcast()
+		s.c.removeIBBStream(s)
+		return NewStanzaError("wait", "resource-constraint")
+	}
+	s.inSeq++
+	s.buf.Write(b)
+	s.cond.Broadcast()
+	return nil
+}
+
+// fail ends reading with err, once the data already received has been read.
+func (s *IBBStream) fail(err error) {
+	s.mu.Lock()
+	if s.readErr == nil {
+		s.readErr = err
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	s.closeOnce.Do(func() { close(s.closed) })
+}
+
+// Read reads data received from the peer. It returns io.EOF once the peer
+// closed the stream.
+func (s *IBBStream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.buf.Len() == 0 && s.readErr == nil {
+		s.cond.Wait()
+	}
+	if s.buf.Len() > 0 {
+		return s.buf.Read(p)
+	}
+	return 0, s.readErr
+}
+
+// Write sends p to the peer in as many blocks as needed.
+func (s *IBBStream) Write(p []byte) (int, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	n := 0
+	for len(p) > 0 {
+		if s.writeErr != nil {
+			return n, s.writeErr
+		}
+		select {
+		case <-s.closed:
+			return n, io.ErrClosedPipe
+		default:
+		}
+
+		block := p
+		if len(block) > s.blockSize {
+			block = block[:s.blockSize]
+		}
+		if err := s.send(block); err != nil {
+			s.writeErr = err
+			return n, err
+		}
+		s.outSeq++
+		n += len(block)
+		p = p[len(block):]
+	}
+	return n, nil
+}
+
+func (s *IBBStream) send(block []byte) error {
+	data := fmt.Sprintf(
+		"<data xmlns='%s' seq='%d' sid='%s'>%s</data>",
+		nsIBB,
+		s.outSeq,
+		xmlEscape(s.sid),
+		base64.StdEncoding.EncodeToString(block),
+	)
+	if s.stanza == IBBStanzaMessage {
+		_, err := fmt.Fprintf(s.c.out, "<message to='%s' id='%s'>%s</message>", xmlEscape(s.peer), s.c.getId(), data)
+		return err
+	}
+	_, err := s.c.sendIQ(context.Background(), s.peer, "set", data)
+	return err
+}
+
+// Close closes the stream in both directions.
+//
+//	<iq from='romeo@montague.net/orchard' id='us71g45j' to='juliet@capulet.com/balcony' type='set'>
+//	  <close xmlns='http://jabber.org/protocol/ibb' sid='i781hf64'/>
+//	</iq>
+func (s *IBBStream) Close() error {
+	select {
+	case <-s.closed:
+		return nil
+	default:
+	}
+	s.c.removeIBBStream(s)
+	s.fail(io.ErrClosedPipe)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_, err := s.c.sendIQ(context.Background(), s.peer, "set", fmt.Sprintf("<close xmlns='%s' sid='%s'/>", nsIBB, xmlEscape(s.sid)))
+	if e, ok := err.(*ClientError); ok && e.Any.Local == "item-not-found" {
+		// The peer closed it first.
+		return nil
+	}
+	return err
+}
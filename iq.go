@@ -0,0 +1,192 @@
+package xmppclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrClosed is returned by requests that were still waiting for a reply
+// when the connection stopped being read.
+var ErrClosed = errors.New("xmpp: connection closed")
+
+// errAsync is returned by IQ handlers that send the reply themselves, later
+// and from another goroutine.
+var errAsync = errors.New("xmpp: IQ answered asynchronously")
+
+// Error makes a stanza error usable as a Go error.
+func (e *ClientError) Error() string {
+	s := "xmpp: " + e.Type
+	if e.Any.Local != "" {
+		s += " " + e.Any.Local
+	}
+	if e.Text != "" {
+		s += ": " + e.Text
+	}
+	return s
+}
+
+// sendIQ sends an IQ request of type typ ("get" or "set") with payload as its
+// child, and waits for the result. A type='error' reply is returned as a
+// *ClientError. Replies are read by Listen, so sendIQ must not be called from
+// the goroutine running Listen, e.g. directly inside a Handler method.
+func (c *Conn) sendIQ(ctx context.Context, to, typ, payload string) (*ClientIQ, error) {
+	id := c.getId()
+	ch := make(chan *ClientIQ, 1)
+
+	c.iqMu.Lock()
+	c.pendingIQ[id] = ch
+	c.iqMu.Unlock()
+	defer func() {
+		c.iqMu.Lock()
+		delete(c.pendingIQ, id)
+		c.iqMu.Unlock()
+	}()
+
+	var err error
+	if to == "" {
+		_, err = fmt.Fprintf(c.out, "<iq id='%s' type='%s'>%s</iq>", id, typ, payload)
+	} else {
+		_, err = fmt.Fprintf(c.out, "<iq to='%s' id='%s' type='%s'>%s</iq>", xmlEscape(to), id, typ, payload)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		select {
+		case iq := <-ch:
+			if !c.isReplyFrom(to, iq.From) {
+				// Somebody else guessed the id; keep waiting for the real reply.
+				continue
+			}
+			if iq.Type == "error" {
+				return iq, &iq.Error
+			}
+			return iq, nil
+		case <-c.done:
+			return nil, ErrClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// isReplyFrom reports whether from is an acceptable sender for the reply to
+// a request sent to to. Requests without to are answered by our own account,
+// which servers may stamp with our bare JID, full JID or nothing at all.
+func (c *Conn) isReplyFrom(to, from string) bool {
+	if from == to {
+		return true
+	}
+	if to == "" || to == RemoveResourceFromJid(c.Jid) {
+		return from == "" || from == c.Jid || from == RemoveResourceFromJid(c.Jid) || from == c.Domain
+	}
+	return false
+}
+
+// deliverIQ hands a result or error to the request waiting for it. It
+// returns false when nobody is waiting.
+func (c *Conn) deliverIQ(iq *ClientIQ) bool {
+	c.iqMu.Lock()
+	ch, ok := c.pendingIQ[iq.Id]
+	c.iqMu.Unlock()
+	if !ok {
+		return false
+	}
+	select {
+	case ch <- iq:
+	default:
+	}
+	return true
+}
+
+// unmarshalQuery decodes the child element of an IQ into v. An empty result
+// leaves v untouched.
+func unmarshalQuery(iq *ClientIQ, v interface{}) error {
+	err := xml.Unmarshal(iq.Query, v)
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// IQHandlerFunc answers an incoming get or set IQ. The returned string is
+// sent as the payload of the result; a non-nil error is sent back as an error
+// reply, using its condition if it is a *ClientError.
+type IQHandlerFunc func(iq *ClientIQ) (string, error)
+
+// HandleIQ registers h to answer get and set IQs whose child element is
+// space local. Handlers run on the goroutine calling Listen, so they must not
+// block on other requests. Requests nobody handles are answered with
+// service-unavailable.
+func (c *Conn) HandleIQ(space, local string, h IQHandlerFunc) {
+	c.iqMu.Lock()
+	defer c.iqMu.Unlock()
+	c.iqHandlers[space+" "+local] = h
+}
+
+// handleIQ answers an incoming get or set request.
+func (c *Conn) handleIQ(iq *ClientIQ) {
+	var h IQHandlerFunc
+	if se, err := nextStart(xml.NewDecoder(bytes.NewReader(iq.Query))); err == nil {
+		c.iqMu.Lock()
+		h = c.iqHandlers[se.Name.Space+" "+se.Name.Local]
+		c.iqMu.Unlock()
+	}
+	if h == nil {
+		c.sendIQError(iq, NewStanzaError("cancel", "service-unavailable"))
+		return
+	}
+
+	payload, err := h(iq)
+	if err == errAsync {
+		return
+	}
+	if err != nil {
+		c.sendIQError(iq, err)
+		return
+	}
+	c.sendIQResult(iq, payload)
+}
+
+func (c *Conn) sendIQResult(iq *ClientIQ, payload string) error {
+	_, err := fmt.Fprintf(c.out, "<iq%s id='%s' type='result'>%s</iq>", replyTo(iq.From), xmlEscape(iq.Id), payload)
+	return err
+}
+
+func (c *Conn) sendIQError(iq *ClientIQ, e error) error {
+	stanzaErr, ok := e.(*ClientError)
+	if !ok {
+		stanzaErr = NewStanzaError("wait", "internal-server-error")
+	}
+	_, err := fmt.Fprintf(c.out, "<iq%s id='%s' type='error'>%s</iq>", replyTo(iq.From), xmlEscape(iq.Id), stanzaErr.marshal())
+	return err
+}
+
+// replyTo addresses a reply to from; stanzas without from came from our own
+// account and are answered without to.
+func replyTo(from string) string {
+	if from == "" {
+		return ""
+	}
+	return " to='" + xmlEscape(from) + "'"
+}
+
+// NewStanzaError returns an error with the given type (auth, cancel,
+// continue, modify or wait) and RFC 6120 defined condition, such as
+// "item-not-found", for use as an IQHandlerFunc result.
+func NewStanzaError(typ, condition string) *ClientError {
+	return &ClientError{Type: typ, Any: xml.Name{Space: nsStanzas, Local: condition}}
+}
+
+func (e *ClientError) marshal() string {
+	s := fmt.Sprintf("<error type='%s'><%s xmlns='%s'/>", xmlEscape(e.Type), e.Any.Local, nsStanzas)
+	if e.Text != "" {
+		s += fmt.Sprintf("<text xmlns='%s'>%s</text>", nsStanzas, xmlEscape(e.Text))
+	}
+	return s + "</error>"
+}
@@ -0,0 +1,445 @@
+package xmppclient
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Jingle, XEP-0166, and Jingle File Transfer, XEP-0234
+// http://xmpp.org/extensions/xep-0166.html
+// http://xmpp.org/extensions/xep-0234.html
+
+// The transports SendFile can use.
+const (
+	TransportIBB    = nsJingleIBB
+	TransportSOCKS5 = nsJingleS5B
+)
+
+// ErrDeclined is returned by SendFile when the peer declines the file.
+var ErrDeclined = errors.New("xmpp: file transfer declined")
+
+// How long we wait for the peer to acknowledge the end of a session, and
+// how long offers wait to be accepted or declined before being terminated.
+const (
+	jingleTerminateTimeout = 10 * time.Second
+	jingleOfferTimeout     = 5 * time.Minute
+)
+
+// ErrOfferExpired is returned by FileOffer.Accept once the offer timed out.
+var ErrOfferExpired = errors.New("xmpp: file offer expired")
+
+// JingleSession is a Jingle session with a peer, transferring the single
+// content of a file offer.
+type JingleSession struct {
+	c         *Conn
+	peer      string
+	sid       string
+	initiator string
+	content   string
+	transport jingleTransport
+
+	// actions receives session-accept and transport-info from the peer.
+	actions chan *Jingle
+
+	endOnce sync.Once
+	ended   chan struct{}
+	reason  string
+}
+
+// jingleTransport establishes the bytestream of a session.
+type jingleTransport interface {
+	// offer returns the <transport/> proposed in session-initiate.
+	offer(ctx context.Context, s *JingleSession) (string, error)
+	// accept checks the transport proposed by the initiator and returns the
+	// one to answer with in session-accept.
+	accept(s *JingleSession, proposed *JingleContent) (string, error)
+	// connect establishes the bytestream once the session is accepted.
+	// content is the content of session-accept for the initiator, and of
+	// session-initiate for the responder.
+	connect(ctx context.Context, s *JingleSession, content *JingleContent) (io.ReadWriteCloser, error)
+	// close releases what offer or accept set up for a bytestream that was
+	// not connected.
+	close()
+}
+
+func (c *Conn) newJingleSession(peer, sid, initiator string) *JingleSession {
+	return &JingleSession{
+		c:         c,
+		peer:      peer,
+		sid:       sid,
+		initiator: initiator,
+		content:   "file",
+		actions:   make(chan *Jingle, 8),
+		ended:     make(chan struct{}),
+	}
+}
+
+func jingleKey(peer, sid string) string {
+	return peer + " " + sid
+}
+
+func (c *Conn) addJingleSession(s *JingleSession) bool {
+	c.jingleMu.Lock()
+	defer c.jingleMu.Unlock()
+	key := jingleKey(s.peer, s.sid)
+	if _, ok := c.jingleSessions[key]; ok {
+		return false
+	}
+	c.jingleSessions[key] = s
+	return true
+}
+
+func (c *Conn) jingleSession(peer, sid string) *JingleSession {
+	c.jingleMu.Lock()
+	defer c.jingleMu.Unlock()
+	return c.jingleSessions[jingleKey(peer, sid)]
+}
+
+// Peer returns the JID at the other end of the session.
+func (s *JingleSession) Peer() string { return s.peer }
+
+// Sid returns the session id.
+func (s *JingleSession) Sid() string { return s.sid }
+
+func (s *JingleSession) isInitiator() bool {
+	return s.initiator == s.c.Jid
+}
+
+// end marks the session as over for reason, a condition such as "success".
+// It reports whether the session was still going.
+func (s *JingleSession) end(reason string) bool {
+	ended := false
+	s.endOnce.Do(func() {
+		ended = true
+		s.reason = reason
+		close(s.ended)
+		s.c.jingleMu.Lock()
+		delete(s.c.jingleSessions, jingleKey(s.peer, s.sid))
+		s.c.jingleMu.Unlock()
+	})
+	return ended
+}
+
+// err describes why the peer ended the session.
+func (s *JingleSession) err() error {
+	if s.reason == "decline" {
+		return ErrDeclined
+	}
+	return errors.New("xmpp: jingle session terminated: " + s.reason)
+}
+
+// send sends a Jingle action about our content with payload as its
+// description and transport.
+func (s *JingleSession) send(ctx context.Context, action, payload string) error {
+	attrs := ""
+	switch action {
+	case "session-initiate":
+		attrs = fmt.Sprintf(" initiator='%s'", xmlEscape(s.c.Jid))
+	case "session-accept":
+		attrs = fmt.Sprintf(" responder='%s'", xmlEscape(s.c.Jid))
+	}
+	_, err := s.c.sendIQ(ctx, s.peer, "set", fmt.Sprintf(
+		"<jingle xmlns='%s' action='%s'%s sid='%s'><content creator='initiator' name='%s' senders='initiator'>%s</content></jingle>",
+		nsJingle,
+		action,
+		attrs,
+		xmlEscape(s.sid),
+		xmlEscape(s.content),
+		payload,
+	))
+	return err
+}
+
+// terminate ends the session, telling the peer the condition why.
+//
+//	<iq from='romeo@montague.example/dr4hcr0st3lup4c' id='bv81gs75' to='juliet@capulet.example/yn0cl4bnw0yr3vym' type='set'>
+//	  <jingle xmlns='urn:xmpp:jingle:1' action='session-terminate' sid='851ba2'>
+//	    <reason><success/></reason>
+//	  </jingle>
+//	</iq>
+func (s *JingleSession) terminate(condition string) error {
+	if !s.end(condition) {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), jingleTerminateTimeout)
+	defer cancel()
+	_, err := s.c.sendIQ(ctx, s.peer, "set", fmt.Sprintf(
+		"<jingle xmlns='%s' action='session-terminate' sid='%s'><reason><%s/></reason></jingle>",
+		nsJingle,
+		xmlEscape(s.sid),
+		condition,
+	))
+	if e, ok := err.(*ClientError); ok && e.Any.Local == "item-not-found" {
+		// The peer ended it too.
+		return nil
+	}
+	return err
+}
+
+// waitAction returns the next action of the peer named action.
+func (s *JingleSession) waitAction(ctx context.Context, action string) (*Jingle, error) {
+	for {
+		select {
+		case j := <-s.actions:
+			if j.Action == action {
+				return j, nil
+			}
+		case <-s.ended:
+			return nil, s.err()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func newJingleTransport(ns string) (jingleTransport, error) {
+	switch ns {
+	case nsJingleIBB:
+		return new(ibbTransport), nil
+	case nsJingleS5B:
+		return new(s5bTransport), nil
+	}
+	return nil, errors.New("xmpp: unknown jingle transport " + ns)
+}
+
+// SendFile offers file to the full JID to over a Jingle session using the
+// given transport (TransportIBB or TransportSOCKS5), and sends the contents
+// of r once the peer accepts. It returns ErrDeclined if the peer declines.
+//
+//	<iq from='romeo@montague.example/dr4hcr0st3lup4c' id='nzu25s8' to='juliet@capulet.example/yn0cl4bnw0yr3vym' type='set'>
+//	  <jingle xmlns='urn:xmpp:jingle:1' action='session-initiate' initiator='romeo@montague.example/dr4hcr0st3lup4c' sid='851ba2'>
+//	    <content creator='initiator' name='a-file-offer' senders='initiator'>
+//	      <description xmlns='urn:xmpp:jingle:apps:file-transfer:5'>
+//	        <file>
+//	          <media-type>text/plain</media-type>
+//	          <name>test.txt</name>
+//	          <size>6144</size>
+//	        </file>
+//	      </description>
+//	      <transport xmlns='urn:xmpp:jingle:transports:s5b:1' mode='tcp' sid='vj3hs98y'>
+//	        <candidate cid='hft54dqy' host='192.168.4.1' jid='romeo@montague.example/dr4hcr0st3lup4c' port='5086' priority='8257636' type='direct'/>
+//	      </transport>
+//	    </content>
+//	  </jingle>
+//	</iq>
+func (c *Conn) SendFile(ctx context.Context, to string, file JingleFile, r io.Reader, transport string) error {
+	tr, err := newJingleTransport(transport)
+	if err != nil {
+		return err
+	}
+	s := c.newJingleSession(to, c.getId(), c.Jid)
+	s.transport = tr
+	defer tr.close()
+	if !c.addJingleSession(s) {
+		return errors.New("xmpp: jingle session " + s.sid + " already exists")
+	}
+
+	offer, err := tr.offer(ctx, s)
+	if err != nil {
+		s.end("failed-transport")
+		return err
+	}
+	description, err := xml.Marshal(FileTransferDescription{File: file})
+	if err != nil {
+		s.end("failed-application")
+		return err
+	}
+	if err = s.send(ctx, "session-initiate", string(description)+offer); err != nil {
+		s.end("failed-application")
+		return err
+	}
+
+	accept, err := s.waitAction(ctx, "session-accept")
+	if err != nil {
+		if err == ctx.Err() {
+			s.terminate("cancel")
+		}
+		return err
+	}
+	if len(accept.Contents) == 0 {
+		s.terminate("failed-application")
+		return errors.New("xmpp: session-accept without content")
+	}
+
+	stream, err := tr.connect(ctx, s, &accept.Contents[0])
+	if err != nil {
+		s.terminate("connectivity-error")
+		return err
+	}
+	_, err = io.Copy(stream, r)
+	if cerr := stream.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		s.terminate("failed-transport")
+		return err
+	}
+	return s.terminate("success")
+}
+
+// FileOffer is a file a peer offered to send us. Offers neither accepted nor
+// declined within five minutes are terminated.
+type FileOffer struct {
+	From    string
+	File    JingleFile
+	s       *JingleSession
+	c       *JingleContent
+	expires *time.Timer
+}
+
+// Session returns the Jingle session the file is offered in.
+func (o *FileOffer) Session() *JingleSession { return o.s }
+
+// Accept accepts the file and returns its contents once the transport is
+// established. Reading returns io.EOF once the whole file arrived. Like all
+// requests, it must not be called from the goroutine running Listen.
+//
+//	<iq from='juliet@capulet.example/yn0cl4bnw0yr3vym' id='jsd71b93' to='romeo@montague.example/dr4hcr0st3lup4c' type='set'>
+//	  <jingle xmlns='urn:xmpp:jingle:1' action='session-accept' responder='juliet@capulet.example/yn0cl4bnw0yr3vym' sid='851ba2'>
+//	    <content creator='initiator' name='a-file-offer' senders='initiator'>
+//	      <description xmlns='urn:xmpp:jingle:apps:file-transfer:5'>...</description>
+//	      <transport xmlns='urn:xmpp:jingle:transports:s5b:1' mode='tcp' sid='vj3hs98y'/>
+//	    </content>
+//	  </jingle>
+//	</iq>
+func (o *FileOffer) Accept(ctx context.Context) (io.ReadCloser, error) {
+	if !o.expires.Stop() {
+		return nil, ErrOfferExpired
+	}
+	s := o.s
+	defer s.transport.close()
+
+	answer, err := s.transport.accept(s, o.c)
+	if err != nil {
+		s.terminate("failed-transport")
+		return nil, err
+	}
+	description, err := xml.Marshal(FileTransferDescription{File: o.File})
+	if err != nil {
+		s.terminate("failed-application")
+		return nil, err
+	}
+	if err = s.send(ctx, "session-accept", string(description)+answer); err != nil {
+		s.end("failed-application")
+		return nil, err
+	}
+
+	stream, err := s.transport.connect(ctx, s, o.c)
+	if err != nil {
+		s.terminate("connectivity-error")
+		return nil, err
+	}
+	return &jingleStream{stream, s}, nil
+}
+
+// Decline refuses the file. It must not be called from the goroutine running
+// Listen.
+func (o *FileOffer) Decline() error {
+	o.expires.Stop()
+	return o.s.terminate("decline")
+}
+
+// jingleStream ends the session along with the bytestream.
+type jingleStream struct {
+	io.ReadWriteCloser
+	s *JingleSession
+}
+
+func (js *jingleStream) Close() error {
+	err := js.ReadWriteCloser.Close()
+	if terr := js.s.terminate("success"); err == nil {
+		err = terr
+	}
+	return err
+}
+
+// answerJingle dispatches the actions of peers to their sessions.
+func (c *Conn) answerJingle(iq *ClientIQ) (string, error) {
+	var j Jingle
+	if err := xml.Unmarshal(iq.Query, &j); err != nil || j.Sid == "" {
+		return "", NewStanzaError("modify", "bad-request")
+	}
+	if j.Action == "session-initiate" {
+		return c.recvFileOffer(iq, &j)
+	}
+
+	s := c.jingleSession(iq.From, j.Sid)
+	if s == nil {
+		return "", NewStanzaError("cancel", "item-not-found")
+	}
+	switch j.Action {
+	case "session-terminate":
+		reason := "success"
+		if j.Reason != nil && j.Reason.Condition.Local != "" {
+			reason = j.Reason.Condition.Local
+		}
+		s.end(reason)
+	case "session-accept", "transport-info":
+		select {
+		case s.actions <- &j:
+		default:
+		}
+	default:
+		return "", NewStanzaError("cancel", "feature-not-implemented")
+	}
+	return "", nil
+}
+
+// recvFileOffer acknowledges a session-initiate and offers the file to the
+// Handler. Offers we cannot handle are acknowledged and then terminated, as
+// XEP-0166 requires.
+func (c *Conn) recvFileOffer(iq *ClientIQ, j *Jingle) (string, error) {
+	h, ok := c.Handler.(JingleHandler)
+	if !ok || !c.jingleAccept {
+		return "", NewStanzaError("cancel", "service-unavailable")
+	}
+	if j.Initiator == "" {
+		j.Initiator = iq.From
+	}
+	if j.Initiator != iq.From {
+		return "", NewStanzaError("modify", "bad-request")
+	}
+	s := c.newJingleSession(iq.From, j.Sid, j.Initiator)
+	if !c.addJingleSession(s) {
+		return "", NewStanzaError("cancel", "conflict")
+	}
+
+	var content *JingleContent
+	reason := "unsupported-applications"
+	for i := range j.Contents {
+		if j.Contents[i].Description == nil {
+			continue
+		}
+		reason = "unsupported-transports"
+		switch {
+		case j.Contents[i].IBB != nil:
+			s.transport = new(ibbTransport)
+		case j.Contents[i].S5B != nil:
+			s.transport = new(s5bTransport)
+		default:
+			continue
+		}
+		content = &j.Contents[i]
+		break
+	}
+	if content == nil {
+		c.sendIQResult(iq, "")
+		go s.terminate(reason)
+		return "", errAsync
+	}
+
+	s.content = content.Name
+	h.RecvFileOffer(&FileOffer{
+		From:    iq.From,
+		File:    content.Description.File,
+		s:       s,
+		c:       content,
+		expires: time.AfterFunc(jingleOfferTimeout, func() { s.terminate("timeout") }),
+	})
+	return "", nil
+}
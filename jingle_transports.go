@@ -0,0 +1,260 @@
+package xmppclient
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+)
+
+// Jingle In-Band Bytestreams Transport Method, XEP-0261
+// http://xmpp.org/extensions/xep-0261.html
+
+type ibbTransport struct {
+	sid       string
+	blockSize int
+	expected  chan *IBBStream
+	cancel    func()
+}
+
+// offer proposes our configured block size.
+//
+//	<transport xmlns='urn:xmpp:jingle:transports:ibb:1' block-size='4096' sid='ch3d9s71'/>
+func (t *ibbTransport) offer(ctx context.Context, s *JingleSession) (string, error) {
+	t.sid = s.c.getId()
+	t.blockSize = s.c.ibbBlockSize
+	return fmt.Sprintf("<transport xmlns='%s' block-size='%d' sid='%s'/>", nsJingleIBB, t.blockSize, xmlEscape(t.sid)), nil
+}
+
+// accept answers with the smaller of the proposed and our own block size,
+// and waits for the initiator to open the stream.
+func (t *ibbTransport) accept(s *JingleSession, proposed *JingleContent) (string, error) {
+	p := proposed.IBB
+	if p == nil || p.Sid == "" || p.BlockSize <= 0 {
+		return "", errors.New("xmpp: invalid IBB transport")
+	}
+	t.sid = p.Sid
+	t.blockSize = p.BlockSize
+	if t.blockSize > s.c.ibbBlockSize {
+		t.blockSize = s.c.ibbBlockSize
+	}
+	t.expected, t.cancel = s.c.expectIBB(s.peer, t.sid)
+	return fmt.Sprintf("<transport xmlns='%s' block-size='%d' sid='%s'/>", nsJingleIBB, t.blockSize, xmlEscape(t.sid)), nil
+}
+
+func (t *ibbTransport) connect(ctx context.Context, s *JingleSession, content *JingleContent) (io.ReadWriteCloser, error) {
+	if s.isInitiator() {
+		blockSize := t.blockSize
+		if content.IBB != nil && content.IBB.BlockSize > 0 && content.IBB.BlockSize < blockSize {
+			blockSize = content.IBB.BlockSize
+		}
+		return s.c.openIBB(ctx, s.peer, t.sid, IBBStanzaIQ, blockSize)
+	}
+
+	select {
+	case stream := <-t.expected:
+		return stream, nil
+	case <-s.ended:
+		return nil, s.err()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (t *ibbTransport) close() {
+	if t.cancel != nil {
+		t.cancel()
+	}
+}
+
+// Jingle SOCKS5 Bytestreams Transport Method, XEP-0260
+// http://xmpp.org/extensions/xep-0260.html
+//
+// Only the initiator offers candidates: our own listener and the proxies of
+// our server. As responder we try the candidates of the initiator.
+
+// Candidate priorities, using the type preferences recommended by XEP-0260.
+const (
+	s5bDirectPriority = 126 << 16
+	s5bProxyPriority  = 10 << 16
+)
+
+type s5bTransport struct {
+	sid        string
+	dst        string
+	candidates []JingleCandidate
+	pending    chan net.Conn
+	cancel     func()
+}
+
+// offer proposes our listener, if any, and the proxies of our server.
+//
+//	<transport xmlns='urn:xmpp:jingle:transports:s5b:1' dstaddr='972b7bf47291ca609517f67f86b5081086052dad' mode='tcp' sid='vj3hs98y'>
+//	  <candidate cid='hft54dqy' host='192.168.4.1' jid='romeo@montague.example/dr4hcr0st3lup4c' port='5086' priority='8257636' type='direct'/>
+//	  <candidate cid='ht567dq' host='24.24.24.1' jid='streamer.shakespeare.example' port='5087' priority='655360' type='proxy'/>
+//	</transport>
+func (t *s5bTransport) offer(ctx context.Context, s *JingleSession) (string, error) {
+	c := s.c
+	t.sid = c.getId()
+	t.dst = socks5DstAddr(t.sid, c.Jid, s.peer)
+
+	if direct, ok := c.socks5StreamHost(); ok {
+		t.pending, t.cancel = c.expectSOCKS5(t.dst)
+		t.candidates = append(t.candidates, JingleCandidate{
+			Cid:      c.getId(),
+			Host:     direct.Host,
+			Jid:      direct.Jid,
+			Port:     direct.Port,
+			Priority: s5bDirectPriority,
+			Type:     "direct",
+		})
+	}
+	proxies, err := c.DiscoverProxies(ctx)
+	if err != nil && len(t.candidates) == 0 {
+		return "", err
+	}
+	for _, p := range proxies {
+		t.candidates = append(t.candidates, JingleCandidate{
+			Cid:      c.getId(),
+			Host:     p.Host,
+			Jid:      p.Jid,
+			Port:     p.Port,
+			Priority: s5bProxyPriority,
+			Type:     "proxy",
+		})
+	}
+	if len(t.candidates) == 0 {
+		return "", errors.New("xmpp: no SOCKS5 candidates to offer")
+	}
+
+	out, err := xml.Marshal(JingleS5BTransport{Sid: t.sid, DstAddr: t.dst, Mode: "tcp", Candidates: t.candidates})
+	return string(out), err
+}
+
+func (t *s5bTransport) accept(s *JingleSession, proposed *JingleContent) (string, error) {
+	p := proposed.S5B
+	if p == nil || p.Sid == "" {
+		return "", errors.New("xmpp: invalid SOCKS5 transport")
+	}
+	if p.Mode == "udp" {
+		return "", errors.New("xmpp: SOCKS5 over UDP is not supported")
+	}
+	t.sid = p.Sid
+	t.candidates = p.Candidates
+	t.dst = p.DstAddr
+	if t.dst == "" {
+		t.dst = socks5DstAddr(t.sid, s.peer, s.c.Jid)
+	}
+	return fmt.Sprintf("<transport xmlns='%s' mode='tcp' sid='%s'/>", nsJingleS5B, xmlEscape(t.sid)), nil
+}
+
+func (t *s5bTransport) connect(ctx context.Context, s *JingleSession, content *JingleContent) (io.ReadWriteCloser, error) {
+	if s.isInitiator() {
+		return t.connectInitiator(ctx, s)
+	}
+	return t.connectResponder(ctx, s)
+}
+
+// connectResponder tries the candidates of the initiator from the highest
+// priority down, and tells it which one worked.
+//
+//	<transport xmlns='urn:xmpp:jingle:transports:s5b:1' sid='vj3hs98y'>
+//	  <candidate-used cid='hr65dqyd'/>
+//	</transport>
+func (t *s5bTransport) connectResponder(ctx context.Context, s *JingleSession) (io.ReadWriteCloser, error) {
+	candidates := append([]JingleCandidate(nil), t.candidates...)
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].Priority > candidates[j].Priority })
+
+	for _, cand := range candidates {
+		dialCtx, cancel := context.WithTimeout(ctx, socks5ConnectTimeout)
+		conn, err := dialSOCKS5(dialCtx, StreamHost{Jid: cand.Jid, Host: cand.Host, Port: cand.Port}, t.dst)
+		cancel()
+		if err != nil {
+			continue
+		}
+		if err = s.send(ctx, "transport-info", fmt.Sprintf(
+			"<transport xmlns='%s' sid='%s'><candidate-used cid='%s'/></transport>",
+			nsJingleS5B,
+			xmlEscape(t.sid),
+			xmlEscape(cand.Cid),
+		)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+
+	s.send(ctx, "transport-info", fmt.Sprintf("<transport xmlns='%s' sid='%s'><candidate-error/></transport>", nsJingleS5B, xmlEscape(t.sid)))
+	return nil, errors.New("xmpp: no SOCKS5 candidate reachable")
+}
+
+// connectInitiator waits for the responder to pick one of our candidates,
+// activating it if it is a proxy.
+func (t *s5bTransport) connectInitiator(ctx context.Context, s *JingleSession) (io.ReadWriteCloser, error) {
+	// We do not try candidates of the responder, but must still say so.
+	if err := s.send(ctx, "transport-info", fmt.Sprintf("<transport xmlns='%s' sid='%s'><candidate-error/></transport>", nsJingleS5B, xmlEscape(t.sid))); err != nil {
+		return nil, err
+	}
+
+	var used *JingleCandidateRef
+	for used == nil {
+		j, err := s.waitAction(ctx, "transport-info")
+		if err != nil {
+			return nil, err
+		}
+		for _, content := range j.Contents {
+			if content.S5B == nil {
+				continue
+			}
+			if content.S5B.CandidateError != nil {
+				return nil, errors.New("xmpp: peer could not reach any SOCKS5 candidate")
+			}
+			if content.S5B.CandidateUsed != nil {
+				used = content.S5B.CandidateUsed
+			}
+		}
+	}
+
+	for _, cand := range t.candidates {
+		if cand.Cid != used.Cid {
+			continue
+		}
+		if cand.Type == "direct" {
+			select {
+			case conn := <-t.pending:
+				return conn, nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		conn, err := dialSOCKS5(ctx, StreamHost{Jid: cand.Jid, Host: cand.Host, Port: cand.Port}, t.dst)
+		if err != nil {
+			return nil, err
+		}
+		if err = s.c.activateSOCKS5(ctx, cand.Jid, t.sid, s.peer); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if err = s.send(ctx, "transport-info", fmt.Sprintf(
+			"<transport xmlns='%s' sid='%s'><activated cid='%s'/></transport>",
+			nsJingleS5B,
+			xmlEscape(t.sid),
+			xmlEscape(cand.Cid),
+		)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	return nil, errors.New("xmpp: peer used unknown SOCKS5 candidate " + used.Cid)
+}
+
+func (t *s5bTransport) close() {
+	if t.cancel != nil {
+		t.cancel()
+	}
+}
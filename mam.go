@@ -0,0 +1,208 @@
+package xmppclient
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Message Archive Management, XEP-0313
+// http://xmpp.org/extensions/xep-0313.html
+
+// ArchiveQuery filters a message archive query. Zero fields are not
+// filtered on.
+type ArchiveQuery struct {
+	// With only matches messages exchanged with this JID.
+	With string
+	// Start and End bound the time the messages were archived.
+	Start time.Time
+	End   time.Time
+
+	// After starts the query after the archive id After, going forward.
+	After string
+	// Before starts the query before the archive id Before, going backward.
+	// Backward with an empty Before pages back from the latest message.
+	Before   string
+	Backward bool
+
+	// PageSize is the number of messages requested per page. Zero lets the
+	// server decide.
+	PageSize int
+}
+
+// ArchivedMessage is a message returned by a message archive query.
+type ArchivedMessage struct {
+	// Id is the archive id of the message, usable as ArchiveQuery.After or
+	// Before.
+	Id string
+	Forwarded
+}
+
+// ArchiveIterator walks through the results of an archive query, requesting
+// pages as needed:
+//
+//	it := c.QueryArchive(ctx, "", ArchiveQuery{With: "juliet@capulet.lit"})
+//	for it.Next() {
+//		msg := it.Message()
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+//
+// Going forward messages come oldest first, going backward newest first.
+type ArchiveIterator struct {
+	c       *Conn
+	ctx     context.Context
+	archive string
+	query   ArchiveQuery
+
+	page     []*ArchivedMessage
+	current  *ArchivedMessage
+	cursor   string
+	started  bool
+	complete bool
+	err      error
+}
+
+// archivePage collects the results of one page while it is being received.
+type archivePage struct {
+	archive string
+	results []*ArchivedMessage
+}
+
+// QueryArchive queries the message archive of archive: empty for our own
+// account, or the JID of a room. The query runs lazily as the iterator
+// advances. Like other requests it must not be driven from the goroutine
+// running Listen.
+func (c *Conn) QueryArchive(ctx context.Context, archive string, q ArchiveQuery) *ArchiveIterator {
+	if q.Before != "" {
+		q.Backward = true
+	}
+	it := &ArchiveIterator{c: c, ctx: ctx, archive: archive, query: q, cursor: q.After}
+	if q.Backward {
+		it.cursor = q.Before
+	}
+	return it
+}
+
+// Next advances to the next message, fetching the next page when the current
+// one is used up. It returns false at the end of the results or on error.
+func (it *ArchiveIterator) Next() bool {
+	for len(it.page) == 0 {
+		if it.err != nil || it.complete {
+			it.current = nil
+			return false
+		}
+		it.fetch()
+	}
+	it.current, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+// Message returns the message Next advanced to.
+func (it *ArchiveIterator) Message() *ArchivedMessage {
+	return it.current
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *ArchiveIterator) Err() error {
+	return it.err
+}
+
+// fetch requests the page following the cursor.
+//
+//	<iq type='set' id='juliet1'>
+//	  <query xmlns='urn:xmpp:mam:2' queryid='f27'>
+//	    <x xmlns='jabber:x:data' type='submit'>...</x>
+//	    <set xmlns='http://jabber.org/protocol/rsm'><max>10</max><after>09af3-cc343-b409f</after></set>
+//	  </query>
+//	</iq>
+func (it *ArchiveIterator) fetch() {
+	c := it.c
+	queryId := c.getId()
+	page := &archivePage{archive: it.archive}
+	c.mamMu.Lock()
+	c.mamQueries[queryId] = page
+	c.mamMu.Unlock()
+	defer func() {
+		c.mamMu.Lock()
+		delete(c.mamQueries, queryId)
+		c.mamMu.Unlock()
+	}()
+
+	q := it.query
+	var payload strings.Builder
+	fmt.Fprintf(&payload, "<query xmlns='%s' queryid='%s'>", nsMam, queryId)
+	fmt.Fprintf(&payload, "<x xmlns='%s' type='submit'><field var='FORM_TYPE' type='hidden'><value>%s</value></field>", nsData, nsMam)
+	if q.With != "" {
+		fmt.Fprintf(&payload, "<field var='with'><value>%s</value></field>", xmlEscape(q.With))
+	}
+	if !q.Start.IsZero() {
+		fmt.Fprintf(&payload, "<field var='start'><value>%s</value></field>", q.Start.UTC().Format(time.RFC3339))
+	}
+	if !q.End.IsZero() {
+		fmt.Fprintf(&payload, "<field var='end'><value>%s</value></field>", q.End.UTC().Format(time.RFC3339))
+	}
+	payload.WriteString("</x>")
+
+	payload.WriteString("<set xmlns='" + nsRSM + "'>")
+	if q.PageSize > 0 {
+		fmt.Fprintf(&payload, "<max>%d</max>", q.PageSize)
+	}
+	switch {
+	case q.Backward:
+		// An empty <before/> asks for the last page.
+		fmt.Fprintf(&payload, "<before>%s</before>", xmlEscape(it.cursor))
+	case it.cursor != "":
+		fmt.Fprintf(&payload, "<after>%s</after>", xmlEscape(it.cursor))
+	}
+	payload.WriteString("</set></query>")
+
+	iq, err := c.sendIQ(it.ctx, it.archive, "set", payload.String())
+	if err != nil {
+		it.err = err
+		return
+	}
+	var fin struct {
+		XMLName  xml.Name  `xml:"urn:xmpp:mam:2 fin"`
+		Complete bool      `xml:"complete,attr"`
+		Set      ResultSet `xml:"http://jabber.org/protocol/rsm set"`
+	}
+	if err = unmarshalQuery(iq, &fin); err != nil {
+		it.err = err
+		return
+	}
+
+	c.mamMu.Lock()
+	results := page.results
+	page.results = nil
+	c.mamMu.Unlock()
+
+	if q.Backward {
+		for i, j := 0, len(results)-1; i < j; i, j = i+1, j-1 {
+			results[i], results[j] = results[j], results[i]
+		}
+		it.cursor = fin.Set.First
+	} else {
+		it.cursor = fin.Set.Last
+	}
+	it.page = results
+	it.complete = fin.Complete || len(results) == 0 || it.cursor == ""
+}
+
+// deliverArchived hands an archive result to the query waiting for it. It
+// returns false if msg is not the answer to one of our queries.
+func (c *Conn) deliverArchived(msg *ClientMessage) bool {
+	result := msg.ArchiveResult
+	c.mamMu.Lock()
+	defer c.mamMu.Unlock()
+	page, ok := c.mamQueries[result.QueryId]
+	if !ok || !c.isReplyFrom(page.archive, msg.From) || result.Forwarded.Message == nil {
+		return false
+	}
+	page.results = append(page.results, &ArchivedMessage{Id: result.Id, Forwarded: result.Forwarded})
+	return true
+}
@@ -0,0 +1,178 @@
+package xmppclient
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Chat Markers, XEP-0333
+// http://xmpp.org/extensions/xep-0333.html
+
+const (
+	MarkerReceived     = "received"
+	MarkerDisplayed    = "displayed"
+	MarkerAcknowledged = "acknowledged"
+)
+
+// maxConversationLog bounds how many received message ids are remembered per
+// conversation for MarkDisplayed, and maxConversations how many
+// conversations are, the least recently active being forgotten first.
+const (
+	maxConversationLog = 256
+	maxConversations   = 1024
+)
+
+// RequestMarkers lets the recipient send chat markers for the message.
+//
+//	<message to='juliet@capulet.lit/balcony' id='message-1' type='chat'>
+//	  <body>My lord, dispatch; read o'er these articles.</body>
+//	  <markable xmlns='urn:xmpp:chat-markers:0'/>
+//	</message>
+func RequestMarkers() MessageOption {
+	return func(m *outgoingMessage) {
+		m.extensions.WriteString("<markable xmlns='" + nsMarkers + "'/>")
+	}
+}
+
+// SendChatMarker sends marker (MarkerReceived, MarkerDisplayed or
+// MarkerAcknowledged) for the message id. chatType is the type of the marked
+// message, chat or groupchat.
+//
+//	<message to='romeo@montague.lit/orchard' id='message-2' type='chat'>
+//	  <displayed xmlns='urn:xmpp:chat-markers:0' id='message-1'/>
+//	</message>
+func (c *Conn) SendChatMarker(to, chatType, marker, id string) error {
+	_, err := fmt.Fprintf(
+		c.out,
+		"<message to='%s' from='%s' type='%s' id='%s'><%s xmlns='%s' id='%s'/></message>",
+		xmlEscape(to),
+		xmlEscape(c.Jid),
+		xmlEscape(chatType),
+		c.getId(),
+		marker,
+		nsMarkers,
+		xmlEscape(id),
+	)
+	return err
+}
+
+// conversation remembers the order of received messages, so that marking
+// one displayed can pick the latest markable message up to it.
+type conversation struct {
+	chatType string
+	ids      []string
+	markable map[string]markerTarget
+	active   uint64 // c.markersClock when a message last arrived
+}
+
+// markerTarget is where the marker for a message goes, and the id it
+// references: the room's stanza-id in groupchat, the message id otherwise.
+type markerTarget struct {
+	to string
+	id string
+}
+
+// conversationKey identifies the conversation with jid: the room for
+// groupchat, the bare JID of the peer otherwise.
+func conversationKey(jid string) string {
+	return RemoveResourceFromJid(jid)
+}
+
+func (c *Conn) trackMarkable(msg *ClientMessage) {
+	// Messages our other resources sent are not part of what we receive.
+	if msg.Id == "" || msg.Type == "error" || msg.Body == "" || msg.Carbon == CarbonSent {
+		return
+	}
+
+	c.markersMu.Lock()
+	defer c.markersMu.Unlock()
+	key := conversationKey(msg.From)
+	conv, ok := c.conversations[key]
+	if !ok {
+		if len(c.conversations) >= maxConversations {
+			c.forgetConversation()
+		}
+		conv = &conversation{markable: make(map[string]markerTarget)}
+		c.conversations[key] = conv
+	}
+	c.markersClock++
+	conv.active = c.markersClock
+	conv.chatType = msg.Type
+	if msg.Type == "" || msg.Type == "normal" {
+		conv.chatType = "chat"
+	}
+
+	conv.ids = append(conv.ids, msg.Id)
+	if msg.Markable != nil {
+		if msg.Type == "groupchat" {
+			// Rooms without stanza-ids leave nothing better than the id.
+			ref := msg.StanzaId(key)
+			if ref == "" {
+				ref = msg.Id
+			}
+			conv.markable[msg.Id] = markerTarget{to: key, id: ref}
+		} else {
+			conv.markable[msg.Id] = markerTarget{to: msg.From, id: msg.Id}
+		}
+	}
+	if len(conv.ids) > maxConversationLog {
+		delete(conv.markable, conv.ids[0])
+		conv.ids = conv.ids[1:]
+	}
+}
+
+// forgetConversation drops the least recently active conversation.
+// c.markersMu must be held.
+func (c *Conn) forgetConversation() {
+	var oldest string
+	for key, conv := range c.conversations {
+		if oldest == "" || conv.active < c.conversations[oldest].active {
+			oldest = key
+		}
+	}
+	delete(c.conversations, oldest)
+}
+
+// MarkDisplayed marks every message received from jid up to and including the
+// one with the given id as displayed. A single displayed marker is sent for
+// the latest markable message among them, as markers implicitly cover earlier
+// messages; nothing is sent when none of them asked for markers. In a room
+// the marker references the stanza-id the room assigned to that message.
+func (c *Conn) MarkDisplayed(jid, id string) error {
+	c.markersMu.Lock()
+	conv, ok := c.conversations[conversationKey(jid)]
+	if !ok {
+		c.markersMu.Unlock()
+		return errors.New("xmpp: no messages received from " + jid)
+	}
+	pos := -1
+	for i, mid := range conv.ids {
+		if mid == id {
+			pos = i
+			break
+		}
+	}
+	if pos == -1 {
+		c.markersMu.Unlock()
+		return errors.New("xmpp: unknown message " + id)
+	}
+	var marked *markerTarget
+	for _, mid := range conv.ids[:pos+1] {
+		if target, ok := conv.markable[mid]; ok {
+			marked = &target
+		}
+		delete(conv.markable, mid)
+	}
+	conv.ids = conv.ids[pos+1:]
+	if len(conv.ids) == 0 {
+		// Everything received was displayed.
+		delete(c.conversations, conversationKey(jid))
+	}
+	chatType := conv.chatType
+	c.markersMu.Unlock()
+
+	if marked == nil {
+		return nil
+	}
+	return c.SendChatMarker(marked.to, chatType, MarkerDisplayed, marked.id)
+}
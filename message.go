@@ -0,0 +1,51 @@
+package xmppclient
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MessageOption adds an extension to a message sent with SendMessage.
+type MessageOption func(m *outgoingMessage)
+
+type outgoingMessage struct {
+	id         string
+	body       string
+	extensions strings.Builder
+	// content is set by options adding text of their own, which OMEMO
+	// cannot encrypt.
+	content bool
+}
+
+// WithBody adds a body in the language lang, alongside the default one.
+func WithBody(lang, body string) MessageOption {
+	return func(m *outgoingMessage) {
+		fmt.Fprintf(&m.extensions, "<body xml:lang='%s'>%s</body>", xmlEscape(lang), xmlEscape(body))
+		m.content = true
+	}
+}
+
+// WithSubject adds a subject in the language lang; an empty lang uses the
+// default language.
+func WithSubject(lang, subject string) MessageOption {
+	return func(m *outgoingMessage) {
+		m.content = true
+		if lang == "" {
+			fmt.Fprintf(&m.extensions, "<subject>%s</subject>", xmlEscape(subject))
+			return
+		}
+		fmt.Fprintf(&m.extensions, "<subject xml:lang='%s'>%s</subject>", xmlEscape(lang), xmlEscape(subject))
+	}
+}
+
+// InThread puts the message in the conversation thread id, spawned from the
+// thread parent, which may be empty.
+func InThread(id, parent string) MessageOption {
+	return func(m *outgoingMessage) {
+		if parent == "" {
+			fmt.Fprintf(&m.extensions, "<thread>%s</thread>", xmlEscape(id))
+			return
+		}
+		fmt.Fprintf(&m.extensions, "<thread parent='%s'>%s</thread>", xmlEscape(parent), xmlEscape(id))
+	}
+}
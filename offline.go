@@ -0,0 +1,105 @@
+package xmppclient
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Flexible Offline Message Retrieval, XEP-0013
+// http://xmpp.org/extensions/xep-0013.html
+//
+// Servers deliver stored messages as soon as we send our initial presence,
+// unless we ask for them first. See Config.InitialPresence.
+
+// OfflineHeader identifies a message in offline storage.
+type OfflineHeader struct {
+	Node string
+	From string
+}
+
+// OfflineCount returns the number of messages in offline storage.
+//
+//	<iq type='get'>
+//	  <query xmlns='http://jabber.org/protocol/disco#info' node='http://jabber.org/protocol/offline'/>
+//	</iq>
+func (c *Conn) OfflineCount(ctx context.Context) (int, error) {
+	info, err := c.DiscoInfo(ctx, "", nsOffline)
+	if err != nil {
+		return 0, err
+	}
+	for _, form := range info.Forms {
+		if form.FormType() != nsOffline {
+			continue
+		}
+		if f := form.Field("number_of_messages"); f != nil && len(f.Values) > 0 {
+			return strconv.Atoi(f.Values[0])
+		}
+	}
+	return 0, nil
+}
+
+// OfflineHeaders lists the messages in offline storage without retrieving
+// them.
+//
+//	<iq type='get'>
+//	  <query xmlns='http://jabber.org/protocol/disco#items' node='http://jabber.org/protocol/offline'/>
+//	</iq>
+func (c *Conn) OfflineHeaders(ctx context.Context) ([]OfflineHeader, error) {
+	items, err := c.DiscoItems(ctx, "", nsOffline)
+	if err != nil {
+		return nil, err
+	}
+	headers := make([]OfflineHeader, 0, len(items))
+	for _, item := range items {
+		headers = append(headers, OfflineHeader{Node: item.Node, From: item.Name})
+	}
+	return headers, nil
+}
+
+// FetchOffline retrieves the messages stored under nodes. They are passed to
+// the Handler, with their Offline field set, before FetchOffline returns.
+// The messages stay in storage until removed.
+//
+//	<iq type='get'>
+//	  <offline xmlns='http://jabber.org/protocol/offline'>
+//	    <item action='view' node='2003-02-27T22:52:37.225Z'/>
+//	  </offline>
+//	</iq>
+func (c *Conn) FetchOffline(ctx context.Context, nodes ...string) error {
+	return c.offlineItems(ctx, "get", "view", nodes)
+}
+
+// RemoveOffline deletes the messages stored under nodes.
+func (c *Conn) RemoveOffline(ctx context.Context, nodes ...string) error {
+	return c.offlineItems(ctx, "set", "remove", nodes)
+}
+
+func (c *Conn) offlineItems(ctx context.Context, typ, action string, nodes []string) error {
+	var items strings.Builder
+	for _, node := range nodes {
+		fmt.Fprintf(&items, "<item action='%s' node='%s'/>", action, xmlEscape(node))
+	}
+	_, err := c.sendIQ(ctx, "", typ, fmt.Sprintf("<offline xmlns='%s'>%s</offline>", nsOffline, items.String()))
+	return err
+}
+
+// FetchAllOffline retrieves all stored messages, which are passed to the
+// Handler before it returns. They stay in storage until purged.
+//
+//	<iq type='get'>
+//	  <offline xmlns='http://jabber.org/protocol/offline'>
+//	    <fetch/>
+//	  </offline>
+//	</iq>
+func (c *Conn) FetchAllOffline(ctx context.Context) error {
+	_, err := c.sendIQ(ctx, "", "get", "<offline xmlns='"+nsOffline+"'><fetch/></offline>")
+	return err
+}
+
+// PurgeOffline deletes all stored messages.
+func (c *Conn) PurgeOffline(ctx context.Context) error {
+	_, err := c.sendIQ(ctx, "", "set", "<offline xmlns='"+nsOffline+"'><purge/></offline>")
+	return err
+}
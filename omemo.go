@@ -0,0 +1,1076 @@
+package xmppclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OMEMO Encryption, XEP-0384
+// http://xmpp.org/extensions/xep-0384.html
+//
+// This is the version of OMEMO deployed by most clients, in the
+// eu.siacs.conversations.axolotl namespace: libsignal sessions carrying the
+// key to an AES-128-GCM encrypted body.
+
+const (
+	nodeOMEMODevices = nsOMEMO + ".devicelist"
+	nodeOMEMOBundles = nsOMEMO + ".bundles:"
+
+	omemoPreKeys  = 100
+	omemoTimeout  = 30 * time.Second
+	omemoFallback = "This message is OMEMO encrypted, but your client does not seem to support it."
+)
+
+// At most omemoMaxPeers peers we sent messages to get their sessions prepared
+// as their messages arrive, for up to omemoMaxPrepared of their devices.
+const (
+	omemoMaxPeers    = 256
+	omemoMaxPrepared = 16
+)
+
+var (
+	// ErrOMEMONoDevices is returned when sending a chat message to a JID
+	// without OMEMO devices, unless OMEMOConfig.AllowPlaintext is set.
+	ErrOMEMONoDevices = errors.New("xmpp: recipient has no OMEMO devices")
+	// ErrOMEMOUntrusted is returned when sending a chat message to a JID
+	// none of whose OMEMO devices is trusted.
+	ErrOMEMOUntrusted = errors.New("xmpp: recipient has no trusted OMEMO devices")
+	// ErrOMEMOUntrustedSender is set as the OMEMOError of messages from
+	// untrusted devices, whose body is withheld.
+	ErrOMEMOUntrustedSender = errors.New("xmpp: OMEMO message from an untrusted device")
+	// ErrOMEMOPlaintext is returned when sending an encrypted chat message
+	// with options whose content would be sent in the clear.
+	ErrOMEMOPlaintext = errors.New("xmpp: message options cannot be OMEMO encrypted")
+
+	errOMEMONotForUs = errors.New("xmpp: OMEMO message not encrypted for this device")
+)
+
+// OMEMOConfig enables OMEMO encryption of one-to-one chat messages. Send,
+// and SendMessage with the "chat" type, then encrypt the body for every
+// trusted device of the recipient and of our own account, and incoming
+// OMEMO messages are decrypted before reaching the Handler.
+//
+// Sending to somebody whose devices are not known yet fetches them, so with
+// OMEMO enabled chat messages must not be sent from the goroutine running
+// Listen, e.g. straight from Handler.RecvMsg.
+//
+// Private messages to the occupants of rooms joined with JoinMUC are never
+// encrypted, as their devices cannot be looked up.
+//
+// Only the body can be encrypted, so options carrying content of their own,
+// such as WithXHTML, WithBody, WithSubject and WithOOB, and chat reactions
+// make sending fail with ErrOMEMOPlaintext rather than leak it.
+type OMEMOConfig struct {
+	// Store persists keys and sessions. When nil, they are kept in memory
+	// and every connection is a new device.
+	Store OMEMOStore
+	// Trust decides whether to trust a device whose identity key we see
+	// for the first time, or whose key changed. It is called when a message
+	// arrives from such a device, on the goroutine running Listen, or when
+	// we first send to it, on the sending goroutine, but never twice at once
+	// and only once per device and key.
+	// When nil, new devices are trusted and changed keys are not. See
+	// Conn.SetOMEMOTrust to change the decision later. Messages from
+	// untrusted devices reach the Handler without their body.
+	Trust func(d OMEMODevice) bool
+	// AllowPlaintext sends chat messages to JIDs without OMEMO devices
+	// unencrypted. Otherwise sending them fails with ErrOMEMONoDevices.
+	AllowPlaintext bool
+}
+
+// OMEMODevice is a device of a JID whose identity key we have seen.
+type OMEMODevice struct {
+	Jid string
+	Id  uint32
+	// IdentityKey is the Curve25519 identity key.
+	IdentityKey []byte
+	Trusted     bool
+}
+
+// Fingerprint returns the identity key in the form users compare.
+func (d *OMEMODevice) Fingerprint() string {
+	return omemoFingerprint(d.IdentityKey)
+}
+
+func omemoFingerprint(key []byte) string {
+	s := hex.EncodeToString(key)
+	var groups []string
+	for len(s) > 8 {
+		groups = append(groups, s[:8])
+		s = s[8:]
+	}
+	return strings.Join(append(groups, s), " ")
+}
+
+type omemoState struct {
+	c         *Conn
+	store     OMEMOStore
+	trust     func(OMEMODevice) bool
+	trustMu   sync.Mutex // held while asking trust
+	plaintext bool
+
+	mu       sync.Mutex
+	identity *OMEMOIdentity
+	devices  map[string][]uint32
+	messaged map[string]bool // JIDs we sent encrypted messages to
+	prepared map[string]bool // JIDs whose devices have sessions
+}
+
+func newOMEMO(c *Conn, config OMEMOConfig) *omemoState {
+	o := &omemoState{
+		c:         c,
+		store:     config.Store,
+		trust:     config.Trust,
+		plaintext: config.AllowPlaintext,
+		devices:   make(map[string][]uint32),
+		messaged:  make(map[string]bool),
+		prepared:  make(map[string]bool),
+	}
+	if o.store == nil {
+		o.store = newMemoryOMEMOStore()
+	}
+	return o
+}
+
+// loadIdentity returns our identity, generating it on first use. o.mu must
+// be held.
+func (o *omemoState) loadIdentity() (*OMEMOIdentity, error) {
+	if o.identity != nil {
+		return o.identity, nil
+	}
+	id, err := o.store.LoadIdentity()
+	if err == ErrOMEMONotFound {
+		if id, err = newOMEMOIdentity(); err == nil {
+			err = o.store.StoreIdentity(id)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	o.identity = id
+	return id, nil
+}
+
+func newOMEMOIdentity() (*OMEMOIdentity, error) {
+	var buf [4]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return nil, err
+	}
+	deviceId := binary.BigEndian.Uint32(buf[:]) & 0x7fffffff
+	if deviceId == 0 {
+		deviceId = 1
+	}
+	seed := make([]byte, ed25519.SeedSize)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, err
+	}
+	spk, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &OMEMOIdentity{
+		DeviceId:              deviceId,
+		IdentityKey:           seed,
+		SignedPreKeyId:        1,
+		SignedPreKey:          spk.Bytes(),
+		SignedPreKeySignature: xeddsaSign(seed, serializeKey(spk.PublicKey().Bytes())),
+		NextPreKeyId:          1,
+	}, nil
+}
+
+// bundle returns our device id and the bundle to publish, generating
+// one-time prekeys to replace the used ones.
+//
+//	<bundle xmlns='eu.siacs.conversations.axolotl'>
+//	  <signedPreKeyPublic signedPreKeyId='1'>BASE64ENCODED...</signedPreKeyPublic>
+//	  <signedPreKeySignature>BASE64ENCODED...</signedPreKeySignature>
+//	  <identityKey>BASE64ENCODED...</identityKey>
+//	  <prekeys>
+//	    <preKeyPublic preKeyId='1'>BASE64ENCODED...</preKeyPublic>
+//	  </prekeys>
+//	</bundle>
+func (o *omemoState) bundle() (uint32, string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	id, err := o.loadIdentity()
+	if err != nil {
+		return 0, "", err
+	}
+	preKeys, err := o.store.LoadPreKeys()
+	if err != nil {
+		return 0, "", err
+	}
+	if len(preKeys) < omemoPreKeys {
+		for len(preKeys) < omemoPreKeys {
+			key, err := ecdh.X25519().GenerateKey(rand.Reader)
+			if err != nil {
+				return 0, "", err
+			}
+			if err = o.store.StorePreKey(id.NextPreKeyId, key.Bytes()); err != nil {
+				return 0, "", err
+			}
+			preKeys[id.NextPreKeyId] = key.Bytes()
+			id.NextPreKeyId++
+		}
+		if err = o.store.StoreIdentity(id); err != nil {
+			return 0, "", err
+		}
+	}
+
+	identity, err := identityKeyPair(id.IdentityKey)
+	if err != nil {
+		return 0, "", err
+	}
+	spk, err := ecdh.X25519().NewPrivateKey(id.SignedPreKey)
+	if err != nil {
+		return 0, "", err
+	}
+	b := OMEMOBundle{
+		SignedPreKey: OMEMOPreKeyPublic{SignedPreKeyId: id.SignedPreKeyId, Key: encodeKey(spk.PublicKey().Bytes())},
+		Signature:    base64.StdEncoding.EncodeToString(id.SignedPreKeySignature),
+		IdentityKey:  encodeKey(identity.PublicKey().Bytes()),
+	}
+	for preKeyId, key := range preKeys {
+		priv, err := ecdh.X25519().NewPrivateKey(key)
+		if err != nil {
+			return 0, "", err
+		}
+		b.PreKeys = append(b.PreKeys, OMEMOPreKeyPublic{PreKeyId: preKeyId, Key: encodeKey(priv.PublicKey().Bytes())})
+	}
+	out, err := xml.Marshal(b)
+	return id.DeviceId, string(out), err
+}
+
+func encodeKey(pub []byte) string {
+	return base64.StdEncoding.EncodeToString(serializeKey(pub))
+}
+
+// decodeBase64 decodes base64 that may be broken into lines.
+func decodeBase64(s string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+}
+
+// PublishOMEMO publishes our bundle and adds our device to the device list
+// of our account. Listen calls it when it starts, and again whenever one
+// of our one-time prekeys was used, so it only needs calling to retry after
+// an error.
+func (c *Conn) PublishOMEMO(ctx context.Context) error {
+	o := c.omemo
+	if o == nil {
+		return errors.New("xmpp: OMEMO is not enabled")
+	}
+	deviceId, bundle, err := o.bundle()
+	if err != nil {
+		return err
+	}
+	if err = c.publishPEP(ctx, nodeOMEMOBundles+strconv.FormatUint(uint64(deviceId), 10), bundle); err != nil {
+		return err
+	}
+
+	own := RemoveResourceFromJid(c.Jid)
+	devices, err := o.fetchDeviceList(ctx, own)
+	if err != nil {
+		return err
+	}
+	for _, id := range devices {
+		if id == deviceId {
+			return nil
+		}
+	}
+	devices = append(devices, deviceId)
+
+	var list strings.Builder
+	fmt.Fprintf(&list, "<list xmlns='%s'>", nsOMEMO)
+	for _, id := range devices {
+		fmt.Fprintf(&list, "<device id='%d'/>", id)
+	}
+	list.WriteString("</list>")
+	if err = c.publishPEP(ctx, nodeOMEMODevices, list.String()); err != nil {
+		return err
+	}
+	o.setDevices(own, devices)
+	return nil
+}
+
+// publishLater publishes our bundle in the background.
+func (o *omemoState) publishLater() {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), omemoTimeout)
+		defer cancel()
+		o.c.PublishOMEMO(ctx)
+	}()
+}
+
+// publishPEP publishes item as the current item of a node of our account,
+// readable by anybody. Servers that do not support publish options get a
+// plain publish.
+//
+//	<iq type='set'>
+//	  <pubsub xmlns='http://jabber.org/protocol/pubsub'>
+//	    <publish node='eu.siacs.conversations.axolotl.devicelist'>
+//	      <item id='current'>
+//	        <list xmlns='eu.siacs.conversations.axolotl'>
+//	          <device id='12345'/>
+//	        </list>
+//	      </item>
+//	    </publish>
+//	    <publish-options>
+//	      <x xmlns='jabber:x:data' type='submit'>
+//	        <field var='FORM_TYPE' type='hidden'>
+//	          <value>http://jabber.org/protocol/pubsub#publish-options</value>
+//	        </field>
+//	        <field var='pubsub#access_model'><value>open</value></field>
+//	      </x>
+//	    </publish-options>
+//	  </pubsub>
+//	</iq>
+func (c *Conn) publishPEP(ctx context.Context, node, item string) error {
+	publish := fmt.Sprintf("<publish node='%s'><item id='current'>%s</item></publish>", xmlEscape(node), item)
+	options := fmt.Sprintf(
+		"<publish-options><x xmlns='%s' type='submit'><field var='FORM_TYPE' type='hidden'><value>%s</value></field><field var='pubsub#access_model'><value>open</value></field></x></publish-options>",
+		nsData,
+		nsPubSubPublishOptions,
+	)
+	_, err := c.sendIQ(ctx, "", "set", "<pubsub xmlns='"+nsPubSub+"'>"+publish+options+"</pubsub>")
+	if _, ok := err.(*ClientError); ok {
+		_, err = c.sendIQ(ctx, "", "set", "<pubsub xmlns='"+nsPubSub+"'>"+publish+"</pubsub>")
+	}
+	return err
+}
+
+// fetchPEP returns the items of a node of jid. A missing node has no items.
+//
+//	<iq type='get' to='juliet@capulet.lit'>
+//	  <pubsub xmlns='http://jabber.org/protocol/pubsub'>
+//	    <items node='eu.siacs.conversations.axolotl.devicelist'/>
+//	  </pubsub>
+//	</iq>
+func (c *Conn) fetchPEP(ctx context.Context, jid, node string) ([]PubSubItem, error) {
+	iq, err := c.sendIQ(ctx, jid, "get", fmt.Sprintf("<pubsub xmlns='%s'><items node='%s'/></pubsub>", nsPubSub, xmlEscape(node)))
+	if e, ok := err.(*ClientError); ok && e.Any.Local == "item-not-found" {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ps PubSub
+	if err = unmarshalQuery(iq, &ps); err != nil {
+		return nil, err
+	}
+	return ps.Items.Items, nil
+}
+
+func parseDeviceList(items []PubSubItem) []uint32 {
+	var devices []uint32
+	for _, item := range items {
+		var list OMEMODeviceList
+		if err := xml.Unmarshal(item.Inner, &list); err != nil {
+			continue
+		}
+		devices = devices[:0]
+		for _, d := range list.Devices {
+			devices = append(devices, d.Id)
+		}
+		if item.Id == "current" {
+			break
+		}
+	}
+	return devices
+}
+
+func (o *omemoState) setDevices(jid string, devices []uint32) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.devices[jid] = devices
+}
+
+// fetchDeviceList fetches the devices of jid, bypassing the cache.
+func (o *omemoState) fetchDeviceList(ctx context.Context, jid string) ([]uint32, error) {
+	items, err := o.c.fetchPEP(ctx, jid, nodeOMEMODevices)
+	if err != nil {
+		return nil, err
+	}
+	devices := parseDeviceList(items)
+	o.setDevices(jid, devices)
+	return devices, nil
+}
+
+// deviceList returns the devices of jid, from the updates the server sends
+// or else fetched.
+func (o *omemoState) deviceList(ctx context.Context, jid string) ([]uint32, error) {
+	o.mu.Lock()
+	devices, ok := o.devices[jid]
+	o.mu.Unlock()
+	if ok {
+		return devices, nil
+	}
+	return o.fetchDeviceList(ctx, jid)
+}
+
+// recvDeviceList applies a device list update, which servers send to us as
+// we advertise the +notify feature. When our own list lacks our device,
+// another client overwrote it and we publish it again.
+//
+//	<message from='juliet@capulet.lit'>
+//	  <event xmlns='http://jabber.org/protocol/pubsub#event'>
+//	    <items node='eu.siacs.conversations.axolotl.devicelist'>
+//	      <item id='current'>
+//	        <list xmlns='eu.siacs.conversations.axolotl'>
+//	          <device id='12345'/>
+//	        </list>
+//	      </item>
+//	    </items>
+//	  </event>
+//	</message>
+func (o *omemoState) recvDeviceList(msg *ClientMessage) {
+	own := RemoveResourceFromJid(o.c.Jid)
+	jid := RemoveResourceFromJid(msg.From)
+	if jid == "" {
+		jid = own
+	}
+	devices := parseDeviceList(msg.Event.Items.Items)
+	o.setDevices(jid, devices)
+	o.mu.Lock()
+	delete(o.prepared, jid)
+	o.mu.Unlock()
+	if jid != own {
+		return
+	}
+
+	o.mu.Lock()
+	id, err := o.loadIdentity()
+	o.mu.Unlock()
+	if err != nil {
+		return
+	}
+	for _, d := range devices {
+		if d == id.DeviceId {
+			return
+		}
+	}
+	o.publishLater()
+}
+
+// encrypt returns the body to send to to in its place: a fallback text and
+// the encrypted body. It returns "" when to has no OMEMO devices and
+// plaintext is allowed. Room occupants have none, their real JIDs being
+// unknown, and with plaintext allowed a failed device list fetch counts as
+// none too. content tells that the message carries content
+// besides the body, which fails before any session advances.
+//
+//	<message to='juliet@capulet.lit' type='chat'>
+//	  <body>This message is OMEMO encrypted, ...</body>
+//	  <encrypted xmlns='eu.siacs.conversations.axolotl'>
+//	    <header sid='27183'>
+//	      <key rid='31415'>BASE64ENCODED...</key>
+//	      <key prekey='true' rid='12321'>BASE64ENCODED...</key>
+//	      <iv>BASE64ENCODED...</iv>
+//	    </header>
+//	    <payload>BASE64ENCODED</payload>
+//	  </encrypted>
+//	  <encryption xmlns='urn:xmpp:eme:0' namespace='eu.siacs.conversations.axolotl' name='OMEMO'/>
+//	  <store xmlns='urn:xmpp:hints'/>
+//	</message>
+func (o *omemoState) encrypt(to, body string, content bool) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), omemoTimeout)
+	defer cancel()
+
+	peer := RemoveResourceFromJid(to)
+	own := RemoveResourceFromJid(o.c.Jid)
+	var peerDevices []uint32
+	var err error
+	if !o.c.isRoom(peer) {
+		if peerDevices, err = o.deviceList(ctx, peer); err != nil && !o.plaintext {
+			return "", err
+		}
+	}
+	if len(peerDevices) == 0 {
+		if !o.plaintext {
+			return "", ErrOMEMONoDevices
+		}
+		return "", nil
+	}
+	if content {
+		return "", ErrOMEMOPlaintext
+	}
+
+	key := make([]byte, 16)
+	iv := make([]byte, 12)
+	if _, err = rand.Read(key); err != nil {
+		return "", err
+	}
+	if _, err = rand.Read(iv); err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nil, iv, []byte(body), nil)
+	ciphertext, tag := sealed[:len(sealed)-gcm.Overhead()], sealed[len(sealed)-gcm.Overhead():]
+	keyMaterial := append(key, tag...)
+
+	var keys strings.Builder
+	n, err := o.encryptKeys(ctx, &keys, peer, peerDevices, keyMaterial)
+	if n == 0 {
+		if err == nil {
+			err = ErrOMEMOUntrusted
+		}
+		return "", err
+	}
+	if peer != own {
+		// Our other devices get a copy too, on a best effort basis.
+		if ownDevices, err := o.deviceList(ctx, own); err == nil {
+			o.encryptKeys(ctx, &keys, own, ownDevices, keyMaterial)
+		}
+	}
+
+	o.mu.Lock()
+	if len(o.messaged) < omemoMaxPeers {
+		o.messaged[peer] = true
+	}
+	id, err := o.loadIdentity()
+	o.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(
+		"<body>%s</body><encrypted xmlns='%s'><header sid='%d'>%s<iv>%s</iv></header><payload>%s</payload></encrypted><encryption xmlns='%s' namespace='%s' name='OMEMO'/><store xmlns='%s'/>",
+		omemoFallback,
+		nsOMEMO,
+		id.DeviceId,
+		keys.String(),
+		base64.StdEncoding.EncodeToString(iv),
+		base64.StdEncoding.EncodeToString(ciphertext),
+		nsEME,
+		nsOMEMO,
+		nsHints,
+	), nil
+}
+
+// encryptKeys writes the key elements for the trusted devices of jid, and
+// returns how many it wrote. Devices that fail are skipped; the first error
+// is returned.
+func (o *omemoState) encryptKeys(ctx context.Context, keys *strings.Builder, jid string, devices []uint32, keyMaterial []byte) (int, error) {
+	n := 0
+	var firstErr error
+	for _, device := range devices {
+		key, preKey, err := o.encryptKey(ctx, jid, device, keyMaterial)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if key == nil {
+			continue
+		}
+		if preKey {
+			fmt.Fprintf(keys, "<key prekey='true' rid='%d'>%s</key>", device, base64.StdEncoding.EncodeToString(key))
+		} else {
+			fmt.Fprintf(keys, "<key rid='%d'>%s</key>", device, base64.StdEncoding.EncodeToString(key))
+		}
+		n++
+	}
+	return n, firstErr
+}
+
+// encryptKey encrypts the key material for a device, starting a session
+// with it if needed. It returns nil for our own device and untrusted ones.
+func (o *omemoState) encryptKey(ctx context.Context, jid string, device uint32, keyMaterial []byte) ([]byte, bool, error) {
+	own, err := o.startSession(ctx, jid, device)
+	if own || err != nil {
+		return nil, false, err
+	}
+	o.mu.Lock()
+	s, err := o.loadSession(jid, device)
+	o.mu.Unlock()
+	if err != nil {
+		return nil, false, err
+	}
+	d, err := o.checkTrust(jid, device, s.RemoteIdentity)
+	if err != nil || !d.Trusted {
+		return nil, false, err
+	}
+
+	// The session may have advanced, or been replaced by one the device
+	// started, while the lock was released; encrypting with a stale copy
+	// would reuse its message keys.
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	id, err := o.loadIdentity()
+	if err != nil {
+		return nil, false, err
+	}
+	identity, err := identityKeyPair(id.IdentityKey)
+	if err != nil {
+		return nil, false, err
+	}
+	if s, err = o.loadSession(jid, device); err != nil {
+		return nil, false, err
+	}
+	if !bytes.Equal(s.RemoteIdentity, d.IdentityKey) {
+		return nil, false, fmt.Errorf("xmpp: OMEMO identity of device %d of %s changed", device, jid)
+	}
+	key, preKey, err := s.encrypt(identity.PublicKey().Bytes(), id.DeviceId, keyMaterial)
+	if err != nil {
+		return nil, false, err
+	}
+	return key, preKey, o.storeSession(jid, device, s)
+}
+
+// startSession starts a session with a device unless there is one already,
+// fetching its bundle. It reports whether the device is our own, with which
+// there are no sessions.
+func (o *omemoState) startSession(ctx context.Context, jid string, device uint32) (own bool, err error) {
+	o.mu.Lock()
+	id, err := o.loadIdentity()
+	if err != nil {
+		o.mu.Unlock()
+		return false, err
+	}
+	if jid == RemoveResourceFromJid(o.c.Jid) && device == id.DeviceId {
+		o.mu.Unlock()
+		return true, nil
+	}
+	_, err = o.loadSession(jid, device)
+	o.mu.Unlock()
+	if err != ErrOMEMONotFound {
+		return false, err
+	}
+
+	identity, err := identityKeyPair(id.IdentityKey)
+	if err != nil {
+		return false, err
+	}
+	b, err := o.c.fetchOMEMOBundle(ctx, jid, device)
+	if err != nil {
+		return false, err
+	}
+	s, err := newInitiatorSession(identity, b)
+	if err != nil {
+		return false, err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	// A session started meanwhile, by the device or another send, wins.
+	if _, err = o.loadSession(jid, device); err != ErrOMEMONotFound {
+		return false, err
+	}
+	return false, o.storeSession(jid, device, s)
+}
+
+// prepareReply prepares sending to the peer of a chat message: its sender,
+// or its recipient for messages sent by our other resources.
+func (o *omemoState) prepareReply(msg *ClientMessage) {
+	if msg.Type != "chat" || msg.Body == "" {
+		return
+	}
+	peer := msg.From
+	if msg.Carbon == CarbonSent {
+		peer = msg.To
+	}
+	if peer = RemoveResourceFromJid(peer); peer != "" && peer != RemoveResourceFromJid(o.c.Jid) {
+		o.prepare(peer)
+	}
+}
+
+// prepare fetches in the background what sending to jid needs, if we sent
+// it messages before: the devices of jid and of our account, and sessions
+// with them, so that replying does not wait for the server.
+func (o *omemoState) prepare(jid string) {
+	own := RemoveResourceFromJid(o.c.Jid)
+	o.mu.Lock()
+	if !o.messaged[jid] || o.prepared[jid] {
+		o.mu.Unlock()
+		return
+	}
+	o.prepared[jid] = true
+	o.mu.Unlock()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), omemoTimeout)
+		defer cancel()
+		var failed bool
+		for _, bare := range []string{jid, own} {
+			devices, err := o.deviceList(ctx, bare)
+			failed = failed || err != nil
+			if len(devices) > omemoMaxPrepared {
+				devices = devices[:omemoMaxPrepared]
+			}
+			for _, device := range devices {
+				_, err := o.startSession(ctx, bare, device)
+				failed = failed || err != nil
+			}
+		}
+		if failed {
+			// Try again with the next message.
+			o.mu.Lock()
+			delete(o.prepared, jid)
+			o.mu.Unlock()
+		}
+	}()
+}
+
+// loadSession returns the session with a device. o.mu must be held.
+func (o *omemoState) loadSession(jid string, device uint32) (*signalSession, error) {
+	raw, err := o.store.LoadSession(jid, device)
+	if err != nil {
+		return nil, err
+	}
+	s := new(signalSession)
+	if err = json.Unmarshal(raw, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// storeSession saves the session with a device. o.mu must be held.
+func (o *omemoState) storeSession(jid string, device uint32, s *signalSession) error {
+	raw, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return o.store.StoreSession(jid, device, raw)
+}
+
+// fetchOMEMOBundle fetches the bundle of a device, picking one of its
+// one-time prekeys at random.
+func (c *Conn) fetchOMEMOBundle(ctx context.Context, jid string, device uint32) (*signalBundle, error) {
+	items, err := c.fetchPEP(ctx, jid, nodeOMEMOBundles+strconv.FormatUint(uint64(device), 10))
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, fmt.Errorf("xmpp: no OMEMO bundle for device %d of %s", device, jid)
+	}
+	var bundle OMEMOBundle
+	if err = xml.Unmarshal(items[0].Inner, &bundle); err != nil {
+		return nil, err
+	}
+
+	b := &signalBundle{SignedPreKeyId: bundle.SignedPreKey.SignedPreKeyId}
+	if b.IdentityKey, err = decodePublicKey(bundle.IdentityKey); err != nil {
+		return nil, err
+	}
+	if b.SignedPreKey, err = decodePublicKey(bundle.SignedPreKey.Key); err != nil {
+		return nil, err
+	}
+	if b.Signature, err = decodeBase64(bundle.Signature); err != nil {
+		return nil, err
+	}
+	if len(bundle.PreKeys) > 0 {
+		i, err := rand.Int(rand.Reader, big.NewInt(int64(len(bundle.PreKeys))))
+		if err != nil {
+			return nil, err
+		}
+		preKey := bundle.PreKeys[i.Int64()]
+		b.PreKeyId = preKey.PreKeyId
+		if b.PreKey, err = decodePublicKey(preKey.Key); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func decodePublicKey(s string) ([]byte, error) {
+	raw, err := decodeBase64(s)
+	if err != nil {
+		return nil, err
+	}
+	return parseKey(raw)
+}
+
+// checkTrust returns the device with the given identity key, asking the
+// Trust callback about devices not seen with that key before. Decisions are
+// taken one at a time, so a device reached from two goroutines at once is
+// asked about once.
+func (o *omemoState) checkTrust(jid string, device uint32, key []byte) (*OMEMODevice, error) {
+	if d, _, err := o.knownDevice(jid, device, key); d != nil || err != nil {
+		return d, err
+	}
+	o.trustMu.Lock()
+	defer o.trustMu.Unlock()
+	d, changed, err := o.knownDevice(jid, device, key)
+	if d != nil || err != nil {
+		return d, err
+	}
+
+	d = &OMEMODevice{Jid: jid, Id: device, IdentityKey: key, Trusted: !changed}
+	if o.trust != nil {
+		d.Trusted = o.trust(*d)
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return d, o.store.StoreDevice(*d)
+}
+
+// knownDevice returns the stored device with the given identity key, or
+// whether the device is stored with another key.
+func (o *omemoState) knownDevice(jid string, device uint32, key []byte) (*OMEMODevice, bool, error) {
+	o.mu.Lock()
+	known, err := o.store.LoadDevices(jid)
+	o.mu.Unlock()
+	if err != nil {
+		return nil, false, err
+	}
+	changed := false
+	for _, d := range known {
+		if d.Id != device {
+			continue
+		}
+		if bytes.Equal(d.IdentityKey, key) {
+			return &d, false, nil
+		}
+		changed = true
+	}
+	return nil, changed, nil
+}
+
+// decrypt replaces the fallback body of an OMEMO message with the decrypted
+// one, and sets its OMEMOSender, or OMEMOError if it cannot be decrypted.
+func (o *omemoState) decrypt(msg *ClientMessage) {
+	body, sender, err := o.decryptMessage(msg)
+	msg.OMEMOSender = sender
+	if err != nil {
+		msg.OMEMOError = err
+		return
+	}
+	if body != nil {
+		msg.Body = string(body)
+		msg.Bodies = []ClientText{{Body: msg.Body}}
+	}
+}
+
+// decryptMessage returns the body of an OMEMO message, nil for messages that
+// only carry keys, and the device that sent it. The session still advances
+// for untrusted devices, so that trusting them later works.
+func (o *omemoState) decryptMessage(msg *ClientMessage) ([]byte, *OMEMODevice, error) {
+	e := msg.OMEMO
+	o.mu.Lock()
+	id, err := o.loadIdentity()
+	o.mu.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	sid, err := strconv.ParseUint(e.Header.Sid, 10, 32)
+	if err != nil {
+		return nil, nil, fmt.Errorf("xmpp: invalid OMEMO device id %q", e.Header.Sid)
+	}
+	var key *OMEMOKey
+	for i := range e.Header.Keys {
+		if rid, err := strconv.ParseUint(e.Header.Keys[i].Rid, 10, 32); err == nil && uint32(rid) == id.DeviceId {
+			key = &e.Header.Keys[i]
+		}
+	}
+	if key == nil {
+		return nil, nil, errOMEMONotForUs
+	}
+	raw, err := decodeBase64(key.Value)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	jid := RemoveResourceFromJid(msg.From)
+	if jid == "" {
+		jid = RemoveResourceFromJid(o.c.Jid)
+	}
+	keyMaterial, remoteIdentity, err := o.decryptKey(jid, uint32(sid), key.IsPreKey(), raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	sender, err := o.checkTrust(jid, uint32(sid), remoteIdentity)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !sender.Trusted {
+		return nil, sender, ErrOMEMOUntrustedSender
+	}
+	if e.Payload == "" {
+		return nil, sender, nil
+	}
+
+	iv, err := decodeBase64(e.Header.IV)
+	if err != nil {
+		return nil, nil, err
+	}
+	payload, err := decodeBase64(e.Payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The authentication tag follows the key, or else the payload.
+	if len(keyMaterial) >= 32 {
+		payload = append(payload, keyMaterial[16:32]...)
+		keyMaterial = keyMaterial[:16]
+	}
+	block, err := aes.NewCipher(keyMaterial)
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := gcm.Open(nil, iv, payload, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return body, sender, nil
+}
+
+// decryptKey decrypts the key material sent to us by a device, starting the
+// session it asks for if it is a prekey message. It returns the key material
+// and the identity key of the device.
+func (o *omemoState) decryptKey(jid string, device uint32, preKey bool, raw []byte) ([]byte, []byte, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	id, err := o.loadIdentity()
+	if err != nil {
+		return nil, nil, err
+	}
+	identity, err := identityKeyPair(id.IdentityKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var s *signalSession
+	var usedPreKey *uint32
+	if preKey {
+		m, err := parsePreKeyMessage(raw)
+		if err != nil {
+			return nil, nil, err
+		}
+		if s, err = o.loadSession(jid, device); err != nil || !bytes.Equal(s.BaseKey, m.baseKey) {
+			if s, err = o.newResponderSession(id, identity, m); err != nil {
+				return nil, nil, err
+			}
+			if m.hasPreKey {
+				usedPreKey = &m.preKeyId
+			}
+		}
+		raw = m.message
+	} else if s, err = o.loadSession(jid, device); err == ErrOMEMONotFound {
+		return nil, nil, fmt.Errorf("xmpp: no OMEMO session with device %d of %s", device, jid)
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	keyMaterial, err := s.decrypt(identity.PublicKey().Bytes(), raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = o.storeSession(jid, device, s); err != nil {
+		return nil, nil, err
+	}
+	if usedPreKey != nil {
+		if err = o.store.RemovePreKey(*usedPreKey); err != nil {
+			return nil, nil, err
+		}
+		o.publishLater()
+	}
+	return keyMaterial, s.RemoteIdentity, nil
+}
+
+// newResponderSession builds the session a prekey message asks for. o.mu
+// must be held.
+func (o *omemoState) newResponderSession(id *OMEMOIdentity, identity *ecdh.PrivateKey, m *signalPreKeyMessage) (*signalSession, error) {
+	if m.signedPreKeyId != id.SignedPreKeyId {
+		return nil, fmt.Errorf("xmpp: unknown OMEMO signed prekey %d", m.signedPreKeyId)
+	}
+	spk, err := ecdh.X25519().NewPrivateKey(id.SignedPreKey)
+	if err != nil {
+		return nil, err
+	}
+	var preKey *ecdh.PrivateKey
+	if m.hasPreKey {
+		preKeys, err := o.store.LoadPreKeys()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := preKeys[m.preKeyId]
+		if !ok {
+			return nil, fmt.Errorf("xmpp: unknown OMEMO prekey %d", m.preKeyId)
+		}
+		if preKey, err = ecdh.X25519().NewPrivateKey(key); err != nil {
+			return nil, err
+		}
+	}
+	return newResponderSession(identity, spk, preKey, m.identityKey, m.baseKey)
+}
+
+// OMEMOFingerprint returns the fingerprint of our own identity key, for
+// contacts to verify.
+func (c *Conn) OMEMOFingerprint() (string, error) {
+	o := c.omemo
+	if o == nil {
+		return "", errors.New("xmpp: OMEMO is not enabled")
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	id, err := o.loadIdentity()
+	if err != nil {
+		return "", err
+	}
+	identity, err := identityKeyPair(id.IdentityKey)
+	if err != nil {
+		return "", err
+	}
+	return omemoFingerprint(identity.PublicKey().Bytes()), nil
+}
+
+// OMEMODevices returns the devices of jid whose identity keys we have seen,
+// with the trust decided for them.
+func (c *Conn) OMEMODevices(jid string) ([]OMEMODevice, error) {
+	o := c.omemo
+	if o == nil {
+		return nil, errors.New("xmpp: OMEMO is not enabled")
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.store.LoadDevices(RemoveResourceFromJid(jid))
+}
+
+// SetOMEMOTrust trusts or distrusts a device of jid, e.g. once the user
+// compared its fingerprint. Messages are only encrypted for trusted devices.
+func (c *Conn) SetOMEMOTrust(jid string, device uint32, trusted bool) error {
+	o := c.omemo
+	if o == nil {
+		return errors.New("xmpp: OMEMO is not enabled")
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	jid = RemoveResourceFromJid(jid)
+	devices, err := o.store.LoadDevices(jid)
+	if err != nil {
+		return err
+	}
+	for _, d := range devices {
+		if d.Id == device {
+			d.Trusted = trusted
+			return o.store.StoreDevice(d)
+		}
+	}
+	return ErrOMEMONotFound
+}
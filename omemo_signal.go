@@ -0,0 +1,609 @@
+package xmppclient
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"sort"
+)
+
+// The Signal protocol as used by OMEMO: X3DH key agreement, the Double
+// Ratchet, and the message format of libsignal version 3.
+// https://signal.org/docs/specifications/x3dh/
+// https://signal.org/docs/specifications/doubleratchet/
+//
+// Our identity key is an Ed25519 key used for X25519 in its Montgomery form,
+// so that plain Ed25519 signatures verify as XEdDSA ones.
+
+const (
+	signalVersion     = 3<<4 | 3
+	signalMACSize     = 8
+	signalKeyType     = 0x05 // prefix of serialized Curve25519 public keys
+	maxSkippedKeys    = 2000
+	maxReceiverChains = 5
+)
+
+var (
+	errSignalMessage = errors.New("xmpp: malformed OMEMO message")
+	errSignalMAC     = errors.New("xmpp: OMEMO message authentication failed")
+	errSignalReplay  = errors.New("xmpp: OMEMO message already decrypted")
+)
+
+// signalSession is the state of a Double Ratchet session with one device. It
+// is stored as JSON.
+type signalSession struct {
+	RemoteIdentity []byte
+	RootKey        []byte
+
+	SenderRatchetKey []byte // X25519 private key
+	SenderChainKey   []byte
+	SenderCounter    uint32
+	PreviousCounter  uint32
+	Receivers        []signalChain
+
+	// Pending is set on sessions we started, until the peer answers, so
+	// that our messages keep carrying what it needs to build the session.
+	Pending *signalPending
+	// BaseKey is the base key of the message that started a session the
+	// peer started, to recognize retransmissions of it.
+	BaseKey []byte
+}
+
+type signalChain struct {
+	RatchetKey []byte
+	ChainKey   []byte
+	Counter    uint32
+	Skipped    map[uint32][]byte
+}
+
+type signalPending struct {
+	HasPreKey      bool
+	PreKeyId       uint32
+	SignedPreKeyId uint32
+	BaseKey        []byte
+}
+
+// signalBundle holds the public keys a device publishes so that others can
+// start sessions with it.
+type signalBundle struct {
+	IdentityKey    []byte
+	SignedPreKeyId uint32
+	SignedPreKey   []byte
+	Signature      []byte
+	PreKeyId       uint32
+	PreKey         []byte
+}
+
+// identityKeyPair returns the X25519 form of the Ed25519 key with the given
+// seed: the clamped scalar Ed25519 derives from it.
+func identityKeyPair(seed []byte) (*ecdh.PrivateKey, error) {
+	h := sha512.Sum512(seed)
+	return ecdh.X25519().NewPrivateKey(h[:32])
+}
+
+// xeddsaSign signs msg with the identity key of the given seed. The sign bit
+// of the Ed25519 public key, which the Montgomery form lacks, travels in the
+// unused top bit of the signature.
+func xeddsaSign(seed, msg []byte) []byte {
+	priv := ed25519.NewKeyFromSeed(seed)
+	sig := ed25519.Sign(priv, msg)
+	sig[63] |= priv.Public().(ed25519.PublicKey)[31] & 0x80
+	return sig
+}
+
+var curve25519P, _ = new(big.Int).SetString("7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffed", 16)
+
+// xeddsaVerify checks an XEdDSA signature by the Curve25519 key pub, by
+// turning the key into its Edwards form y = (u-1)/(u+1).
+func xeddsaVerify(pub, msg, sig []byte) bool {
+	if len(pub) != 32 || len(sig) != 64 {
+		return false
+	}
+	u := littleEndianInt(pub)
+	u.SetBit(u, 255, 0)
+	den := new(big.Int).Add(u, big.NewInt(1))
+	den.Mod(den, curve25519P)
+	if den.Sign() == 0 {
+		return false
+	}
+	y := new(big.Int).Sub(u, big.NewInt(1))
+	y.Mul(y, den.ModInverse(den, curve25519P))
+	y.Mod(y, curve25519P)
+
+	edPub := make([]byte, 32)
+	y.FillBytes(edPub)
+	reverse(edPub)
+	edPub[31] |= sig[63] & 0x80
+	s := append([]byte(nil), sig...)
+	s[63] &= 0x7f
+	return ed25519.Verify(edPub, msg, s)
+}
+
+func littleEndianInt(b []byte) *big.Int {
+	be := append([]byte(nil), b...)
+	reverse(be)
+	return new(big.Int).SetBytes(be)
+}
+
+func reverse(b []byte) {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+}
+
+func serializeKey(pub []byte) []byte {
+	return append([]byte{signalKeyType}, pub...)
+}
+
+// parseKey accepts serialized public keys, and bare ones as some clients
+// publish them.
+func parseKey(b []byte) ([]byte, error) {
+	switch {
+	case len(b) == 33 && b[0] == signalKeyType:
+		return b[1:], nil
+	case len(b) == 32:
+		return b, nil
+	}
+	return nil, errors.New("xmpp: invalid OMEMO public key")
+}
+
+func dh(priv *ecdh.PrivateKey, pub []byte) ([]byte, error) {
+	p, err := ecdh.X25519().NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return priv.ECDH(p)
+}
+
+// x3dh derives the root and chain keys from the key agreement secrets.
+func x3dh(secrets ...[]byte) (rootKey, chainKey []byte, err error) {
+	ikm := bytes.Repeat([]byte{0xff}, 32)
+	for _, s := range secrets {
+		ikm = append(ikm, s...)
+	}
+	keys, err := hkdfSHA256(ikm, nil, "WhisperText", 64)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keys[:32], keys[32:], nil
+}
+
+// newInitiatorSession starts a session with the device that published b.
+func newInitiatorSession(identity *ecdh.PrivateKey, b *signalBundle) (*signalSession, error) {
+	if !xeddsaVerify(b.IdentityKey, serializeKey(b.SignedPreKey), b.Signature) {
+		return nil, errors.New("xmpp: invalid OMEMO signed prekey signature")
+	}
+	base, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := make([][]byte, 0, 4)
+	for _, pair := range []struct {
+		priv *ecdh.PrivateKey
+		pub  []byte
+	}{
+		{identity, b.SignedPreKey},
+		{base, b.IdentityKey},
+		{base, b.SignedPreKey},
+		{base, b.PreKey},
+	} {
+		if pair.pub == nil {
+			continue
+		}
+		s, err := dh(pair.priv, pair.pub)
+		if err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, s)
+	}
+	rootKey, chainKey, err := x3dh(secrets...)
+	if err != nil {
+		return nil, err
+	}
+
+	ratchet, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	rootKey, sendingKey, err := rootStep(rootKey, ratchet, b.SignedPreKey)
+	if err != nil {
+		return nil, err
+	}
+	return &signalSession{
+		RemoteIdentity:   b.IdentityKey,
+		RootKey:          rootKey,
+		SenderRatchetKey: ratchet.Bytes(),
+		SenderChainKey:   sendingKey,
+		Receivers:        []signalChain{{RatchetKey: b.SignedPreKey, ChainKey: chainKey}},
+		Pending: &signalPending{
+			HasPreKey:      b.PreKey != nil,
+			PreKeyId:       b.PreKeyId,
+			SignedPreKeyId: b.SignedPreKeyId,
+			BaseKey:        base.PublicKey().Bytes(),
+		},
+	}, nil
+}
+
+// newResponderSession builds the session a prekey message asks for. preKey
+// is nil when the sender used no one-time prekey.
+func newResponderSession(identity, signedPreKey, preKey *ecdh.PrivateKey, theirIdentity, theirBase []byte) (*signalSession, error) {
+	secrets := make([][]byte, 0, 4)
+	for _, pair := range []struct {
+		priv *ecdh.PrivateKey
+		pub  []byte
+	}{
+		{signedPreKey, theirIdentity},
+		{identity, theirBase},
+		{signedPreKey, theirBase},
+		{preKey, theirBase},
+	} {
+		if pair.priv == nil {
+			continue
+		}
+		s, err := dh(pair.priv, pair.pub)
+		if err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, s)
+	}
+	rootKey, chainKey, err := x3dh(secrets...)
+	if err != nil {
+		return nil, err
+	}
+	return &signalSession{
+		RemoteIdentity:   theirIdentity,
+		RootKey:          rootKey,
+		SenderRatchetKey: signedPreKey.Bytes(),
+		SenderChainKey:   chainKey,
+		BaseKey:          theirBase,
+	}, nil
+}
+
+// hkdfSHA256 derives length bytes from secret as in RFC 5869. A nil salt
+// stands for a block of zeros.
+func hkdfSHA256(secret, salt []byte, info string, length int) ([]byte, error) {
+	if length > 255*sha256.Size {
+		return nil, errors.New("xmpp: HKDF output too long")
+	}
+	if salt == nil {
+		salt = make([]byte, sha256.Size)
+	}
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+
+	var out, block []byte
+	for i := byte(1); len(out) < length; i++ {
+		expand.Reset()
+		expand.Write(block)
+		expand.Write([]byte(info))
+		expand.Write([]byte{i})
+		block = expand.Sum(nil)
+		out = append(out, block...)
+	}
+	return out[:length], nil
+}
+
+// rootStep advances the root chain with a Diffie-Hellman ratchet step.
+func rootStep(rootKey []byte, ours *ecdh.PrivateKey, theirs []byte) (newRoot, chainKey []byte, err error) {
+	secret, err := dh(ours, theirs)
+	if err != nil {
+		return nil, nil, err
+	}
+	keys, err := hkdfSHA256(secret, rootKey, "WhisperRatchet", 64)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keys[:32], keys[32:], nil
+}
+
+// chainStep returns the seed of the message key for the current position of
+// a chain, and the key of the next position.
+func chainStep(chainKey []byte) (seed, next []byte) {
+	mac := hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{1})
+	seed = mac.Sum(nil)
+	mac.Reset()
+	mac.Write([]byte{2})
+	return seed, mac.Sum(nil)
+}
+
+func messageKeys(seed []byte) (cipherKey, macKey, iv []byte, err error) {
+	keys, err := hkdfSHA256(seed, nil, "WhisperMessageKeys", 80)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return keys[:32], keys[32:64], keys[64:], nil
+}
+
+func signalMAC(macKey, senderIdentity, receiverIdentity, message []byte) []byte {
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(serializeKey(senderIdentity))
+	mac.Write(serializeKey(receiverIdentity))
+	mac.Write(message)
+	return mac.Sum(nil)[:signalMACSize]
+}
+
+// encrypt encrypts plaintext with the next key of our sending chain. While
+// the peer has not answered, the message is wrapped in a prekey message.
+func (s *signalSession) encrypt(identity []byte, registrationId uint32, plaintext []byte) (msg []byte, preKey bool, err error) {
+	seed, next := chainStep(s.SenderChainKey)
+	cipherKey, macKey, iv, err := messageKeys(seed)
+	if err != nil {
+		return nil, false, err
+	}
+	ratchet, err := ecdh.X25519().NewPrivateKey(s.SenderRatchetKey)
+	if err != nil {
+		return nil, false, err
+	}
+	ciphertext, err := cbcEncrypt(cipherKey, iv, plaintext)
+	if err != nil {
+		return nil, false, err
+	}
+
+	msg = []byte{signalVersion}
+	msg = appendProtoBytes(msg, 1, serializeKey(ratchet.PublicKey().Bytes()))
+	msg = appendProtoVarint(msg, 2, uint64(s.SenderCounter))
+	msg = appendProtoVarint(msg, 3, uint64(s.PreviousCounter))
+	msg = appendProtoBytes(msg, 4, ciphertext)
+	msg = append(msg, signalMAC(macKey, identity, s.RemoteIdentity, msg)...)
+	s.SenderChainKey = next
+	s.SenderCounter++
+
+	if s.Pending == nil {
+		return msg, false, nil
+	}
+	p := s.Pending
+	out := []byte{signalVersion}
+	if p.HasPreKey {
+		out = appendProtoVarint(out, 1, uint64(p.PreKeyId))
+	}
+	out = appendProtoBytes(out, 2, serializeKey(p.BaseKey))
+	out = appendProtoBytes(out, 3, serializeKey(identity))
+	out = appendProtoBytes(out, 4, msg)
+	out = appendProtoVarint(out, 5, uint64(registrationId))
+	out = appendProtoVarint(out, 6, uint64(p.SignedPreKeyId))
+	return out, true, nil
+}
+
+// decrypt decrypts a message, advancing the ratchets as needed. On error the
+// session is left in an unusable state, so callers only keep it on success.
+func (s *signalSession) decrypt(identity, msg []byte) ([]byte, error) {
+	if len(msg) < 1+signalMACSize || msg[0]>>4 != 3 {
+		return nil, errSignalMessage
+	}
+	body, mac := msg[:len(msg)-signalMACSize], msg[len(msg)-signalMACSize:]
+	varints, fields, err := parseProto(body[1:])
+	if err != nil {
+		return nil, err
+	}
+	ratchetKey, err := parseKey(fields[1])
+	if err != nil {
+		return nil, err
+	}
+
+	chain, err := s.receiverChain(ratchetKey)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := chain.messageKey(uint32(varints[2]))
+	if err != nil {
+		return nil, err
+	}
+	cipherKey, macKey, iv, err := messageKeys(seed)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(mac, signalMAC(macKey, s.RemoteIdentity, identity, body)) {
+		return nil, errSignalMAC
+	}
+	plaintext, err := cbcDecrypt(cipherKey, iv, fields[4])
+	if err != nil {
+		return nil, err
+	}
+	s.Pending = nil
+	return plaintext, nil
+}
+
+// receiverChain returns the chain for the peer's ratchet key, taking a
+// Diffie-Hellman ratchet step when the key is new.
+func (s *signalSession) receiverChain(ratchetKey []byte) (*signalChain, error) {
+	for i := range s.Receivers {
+		if bytes.Equal(s.Receivers[i].RatchetKey, ratchetKey) {
+			return &s.Receivers[i], nil
+		}
+	}
+
+	ours, err := ecdh.X25519().NewPrivateKey(s.SenderRatchetKey)
+	if err != nil {
+		return nil, err
+	}
+	rootKey, receivingKey, err := rootStep(s.RootKey, ours, ratchetKey)
+	if err != nil {
+		return nil, err
+	}
+	next, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	rootKey, sendingKey, err := rootStep(rootKey, next, ratchetKey)
+	if err != nil {
+		return nil, err
+	}
+
+	s.RootKey = rootKey
+	s.Receivers = append(s.Receivers, signalChain{RatchetKey: ratchetKey, ChainKey: receivingKey})
+	if len(s.Receivers) > maxReceiverChains {
+		s.Receivers = s.Receivers[1:]
+	}
+	s.PreviousCounter = 0
+	if s.SenderCounter > 0 {
+		s.PreviousCounter = s.SenderCounter - 1
+	}
+	s.SenderRatchetKey = next.Bytes()
+	s.SenderChainKey = sendingKey
+	s.SenderCounter = 0
+	return &s.Receivers[len(s.Receivers)-1], nil
+}
+
+// messageKey returns the seed of the message key for counter, keeping the
+// keys of skipped messages for when they arrive late.
+func (c *signalChain) messageKey(counter uint32) ([]byte, error) {
+	if counter < c.Counter {
+		seed, ok := c.Skipped[counter]
+		if !ok {
+			return nil, errSignalReplay
+		}
+		delete(c.Skipped, counter)
+		return seed, nil
+	}
+	if counter-c.Counter > maxSkippedKeys {
+		return nil, errors.New("xmpp: too many skipped OMEMO messages")
+	}
+	for ; c.Counter < counter; c.Counter++ {
+		if c.Skipped == nil {
+			c.Skipped = make(map[uint32][]byte)
+		}
+		c.Skipped[c.Counter], c.ChainKey = chainStep(c.ChainKey)
+	}
+	if len(c.Skipped) > maxSkippedKeys {
+		counters := make([]uint32, 0, len(c.Skipped))
+		for n := range c.Skipped {
+			counters = append(counters, n)
+		}
+		sort.Slice(counters, func(i, j int) bool { return counters[i] < counters[j] })
+		for _, n := range counters[:len(counters)-maxSkippedKeys] {
+			delete(c.Skipped, n)
+		}
+	}
+	seed, next := chainStep(c.ChainKey)
+	c.ChainKey = next
+	c.Counter++
+	return seed, nil
+}
+
+// signalPreKeyMessage is the message that starts a session.
+type signalPreKeyMessage struct {
+	registrationId uint32
+	hasPreKey      bool
+	preKeyId       uint32
+	signedPreKeyId uint32
+	baseKey        []byte
+	identityKey    []byte
+	message        []byte
+}
+
+func parsePreKeyMessage(b []byte) (*signalPreKeyMessage, error) {
+	if len(b) < 1 || b[0]>>4 != 3 {
+		return nil, errSignalMessage
+	}
+	varints, fields, err := parseProto(b[1:])
+	if err != nil {
+		return nil, err
+	}
+	m := &signalPreKeyMessage{
+		registrationId: uint32(varints[5]),
+		signedPreKeyId: uint32(varints[6]),
+		message:        fields[4],
+	}
+	m.preKeyId, m.hasPreKey = uint32(varints[1]), hasKey(varints, 1)
+	if m.baseKey, err = parseKey(fields[2]); err != nil {
+		return nil, err
+	}
+	if m.identityKey, err = parseKey(fields[3]); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func hasKey(m map[int]uint64, k int) bool {
+	_, ok := m[k]
+	return ok
+}
+
+// The messages are protocol buffers with varint and bytes fields only.
+
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func parseProto(b []byte) (varints map[int]uint64, fields map[int][]byte, err error) {
+	varints, fields = make(map[int]uint64), make(map[int][]byte)
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, nil, errSignalMessage
+		}
+		b = b[n:]
+		field := int(tag >> 3)
+		switch tag & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return nil, nil, errSignalMessage
+			}
+			varints[field] = v
+			b = b[n:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || l > uint64(len(b)-n) {
+				return nil, nil, errSignalMessage
+			}
+			fields[field] = b[n : n+int(l)]
+			b = b[n+int(l):]
+		default:
+			return nil, nil, errSignalMessage
+		}
+	}
+	return varints, fields, nil
+}
+
+func cbcEncrypt(key, iv, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	pad := aes.BlockSize - len(plaintext)%aes.BlockSize
+	out := append(append([]byte(nil), plaintext...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, out)
+	return out, nil
+}
+
+func cbcDecrypt(key, iv, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, errSignalMessage
+	}
+	out := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, ciphertext)
+	pad := int(out[len(out)-1])
+	if pad == 0 || pad > aes.BlockSize {
+		return nil, errSignalMessage
+	}
+	for _, b := range out[len(out)-pad:] {
+		if int(b) != pad {
+			return nil, errSignalMessage
+		}
+	}
+	return out[:len(out)-pad], nil
+}
@@ -0,0 +1,148 @@
+package xmppclient
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrOMEMONotFound is returned by an OMEMOStore that has no identity or
+// session to load.
+var ErrOMEMONotFound = errors.New("xmpp: OMEMO record not found")
+
+// OMEMOStore persists our OMEMO keys, the sessions with other devices and the
+// trust decided for them. Losing the identity means becoming a new device
+// that contacts have to trust again; losing sessions makes messages already
+// on their way undecryptable. Calls are serialized by the Conn.
+type OMEMOStore interface {
+	// LoadIdentity returns ErrOMEMONotFound on first use, after which a new
+	// identity is generated and stored.
+	LoadIdentity() (*OMEMOIdentity, error)
+	StoreIdentity(id *OMEMOIdentity) error
+
+	// LoadPreKeys returns the private one-time prekeys by id.
+	LoadPreKeys() (map[uint32][]byte, error)
+	StorePreKey(id uint32, key []byte) error
+	RemovePreKey(id uint32) error
+
+	// LoadSession returns ErrOMEMONotFound when there is no session with
+	// the device of jid.
+	LoadSession(jid string, device uint32) ([]byte, error)
+	StoreSession(jid string, device uint32, session []byte) error
+
+	// LoadDevices returns the devices of jid whose identity key we have
+	// seen.
+	LoadDevices(jid string) ([]OMEMODevice, error)
+	StoreDevice(d OMEMODevice) error
+}
+
+// OMEMOIdentity is our own OMEMO device.
+type OMEMOIdentity struct {
+	DeviceId uint32
+	// IdentityKey is the seed of the Ed25519 key whose Curve25519 form is
+	// our identity key.
+	IdentityKey           []byte
+	SignedPreKeyId        uint32
+	SignedPreKey          []byte
+	SignedPreKeySignature []byte
+	// NextPreKeyId is the id of the next one-time prekey to generate.
+	NextPreKeyId uint32
+}
+
+type omemoSessionKey struct {
+	jid    string
+	device uint32
+}
+
+// memoryOMEMOStore keeps everything in memory, for when no store is
+// configured.
+type memoryOMEMOStore struct {
+	mu       sync.Mutex
+	identity *OMEMOIdentity
+	preKeys  map[uint32][]byte
+	sessions map[omemoSessionKey][]byte
+	devices  map[string][]OMEMODevice
+}
+
+func newMemoryOMEMOStore() *memoryOMEMOStore {
+	return &memoryOMEMOStore{
+		preKeys:  make(map[uint32][]byte),
+		sessions: make(map[omemoSessionKey][]byte),
+		devices:  make(map[string][]OMEMODevice),
+	}
+}
+
+func (s *memoryOMEMOStore) LoadIdentity() (*OMEMOIdentity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.identity == nil {
+		return nil, ErrOMEMONotFound
+	}
+	return s.identity, nil
+}
+
+func (s *memoryOMEMOStore) StoreIdentity(id *OMEMOIdentity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.identity = id
+	return nil
+}
+
+func (s *memoryOMEMOStore) LoadPreKeys() (map[uint32][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make(map[uint32][]byte, len(s.preKeys))
+	for id, key := range s.preKeys {
+		keys[id] = key
+	}
+	return keys, nil
+}
+
+func (s *memoryOMEMOStore) StorePreKey(id uint32, key []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.preKeys[id] = key
+	return nil
+}
+
+func (s *memoryOMEMOStore) RemovePreKey(id uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.preKeys, id)
+	return nil
+}
+
+func (s *memoryOMEMOStore) LoadSession(jid string, device uint32) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[omemoSessionKey{jid, device}]
+	if !ok {
+		return nil, ErrOMEMONotFound
+	}
+	return session, nil
+}
+
+func (s *memoryOMEMOStore) StoreSession(jid string, device uint32, session []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[omemoSessionKey{jid, device}] = session
+	return nil
+}
+
+func (s *memoryOMEMOStore) LoadDevices(jid string) ([]OMEMODevice, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]OMEMODevice(nil), s.devices[jid]...), nil
+}
+
+func (s *memoryOMEMOStore) StoreDevice(d OMEMODevice) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, known := range s.devices[d.Jid] {
+		if known.Id == d.Id {
+			s.devices[d.Jid][i] = d
+			return nil
+		}
+	}
+	s.devices[d.Jid] = append(s.devices[d.Jid], d)
+	return nil
+}
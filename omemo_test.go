@@ -0,0 +1,471 @@
+package xmppclient
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func fromHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// RFC 5869, test case 1.
+func TestHKDF(t *testing.T) {
+	ikm := bytes.Repeat([]byte{0x0b}, 22)
+	salt := fromHex(t, "000102030405060708090a0b0c")
+	info := fromHex(t, "f0f1f2f3f4f5f6f7f8f9")
+	okm, err := hkdfSHA256(ikm, salt, string(info), 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := hex.EncodeToString(okm), "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+// The identity key and signed prekey of a libsignal device, as published in
+// its bundle.
+const (
+	libsignalIdentity     = "22e8aeeb09d360784b318e529cb8a68b037b2fca706135c1ad3a142cb5e93d24"
+	libsignalSignedPreKey = "053552523710faba6217059c5a4f4530515fc9d4d23c8b6d7c80f2f2b20a139e38"
+	libsignalSignature    = "f5bac195cb9f4044b4a56d3f63de7fb5100da820dceba85131fe2dc79190edaa393f16ed16340e59889eb723e0793ee1e01a8a9017bd39a10eee4bf0d56d8983"
+)
+
+func TestXEdDSA(t *testing.T) {
+	identity := fromHex(t, libsignalIdentity)
+	spk := fromHex(t, libsignalSignedPreKey)
+	sig := fromHex(t, libsignalSignature)
+	if !xeddsaVerify(identity, spk, sig) {
+		t.Error("signature of libsignal rejected")
+	}
+	spk[len(spk)-1] ^= 1
+	if xeddsaVerify(identity, spk, sig) {
+		t.Error("signature of libsignal accepted for another key")
+	}
+
+	seed := make([]byte, 32)
+	rand.Read(seed)
+	k, err := identityKeyPair(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("message")
+	sig = xeddsaSign(seed, msg)
+	if !xeddsaVerify(k.PublicKey().Bytes(), msg, sig) {
+		t.Error("own signature rejected")
+	}
+	if xeddsaVerify(k.PublicKey().Bytes(), []byte("massage"), sig) {
+		t.Error("own signature accepted for another message")
+	}
+}
+
+// sequence returns the bytes from first on, for keys of known value.
+func sequence(first byte) []byte {
+	b := make([]byte, 32)
+	for i := range b {
+		b[i] = first + byte(i)
+	}
+	return b
+}
+
+// TestSignalPreKeyMessage decrypts the first two messages libsignal sent to
+// a bundle with these keys, in reverse order.
+func TestSignalPreKeyMessage(t *testing.T) {
+	identity, err := identityKeyPair(sequence(0x01))
+	if err != nil {
+		t.Fatal(err)
+	}
+	spk, err := ecdh.X25519().NewPrivateKey(sequence(0x41))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opk, err := ecdh.X25519().NewPrivateKey(sequence(0x81))
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := map[string]string{
+		"first":  "33080312210590a465dfd26683de5c9c0cd22085016711d105291e951c2175bebabe694c5d771a210522e8aeeb09d360784b318e529cb8a68b037b2fca706135c1ad3a142cb5e93d242242330a2105a910cca8a249ce70b2f08b9d37ba9d7c622361ec77c14d10ba06a21ec4a0a676100018002210af93521dbf792b33e888ad04be8c7d999fb83bfd2f2d4e06289d8ec6f8083005",
+		"second": "33080312210590a465dfd26683de5c9c0cd22085016711d105291e951c2175bebabe694c5d771a210522e8aeeb09d360784b318e529cb8a68b037b2fca706135c1ad3a142cb5e93d242242330a2105a910cca8a249ce70b2f08b9d37ba9d7c622361ec77c14d10ba06a21ec4a0a676100118002210d6156d572ac0bab9f1db1869da42e3b40d9997231f5ebd8a289d8ec6f8083005",
+	}
+
+	var s *signalSession
+	for _, want := range []string{"second", "first"} {
+		m, err := parsePreKeyMessage(fromHex(t, messages[want]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.registrationId != 2400290589 || !m.hasPreKey || m.preKeyId != 3 || m.signedPreKeyId != 5 || hex.EncodeToString(m.identityKey) != libsignalIdentity {
+			t.Fatalf("%s: parsed %+v", want, m)
+		}
+		if s == nil {
+			if s, err = newResponderSession(identity, spk, opk, m.identityKey, m.baseKey); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := s.decrypt(identity.PublicKey().Bytes(), m.message)
+		if err != nil || string(got) != want {
+			t.Errorf("got %q, %v, want %q", got, err, want)
+		}
+		if _, err := s.decrypt(identity.PublicKey().Bytes(), m.message); err != errSignalReplay {
+			t.Errorf("%s replayed: %v", want, err)
+		}
+	}
+}
+
+func TestSignalSession(t *testing.T) {
+	newSeed := func() []byte {
+		seed := make([]byte, 32)
+		rand.Read(seed)
+		return seed
+	}
+	newKey := func() *ecdh.PrivateKey {
+		k, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	aliceSeed, bobSeed := newSeed(), newSeed()
+	aliceId, _ := identityKeyPair(aliceSeed)
+	bobId, _ := identityKeyPair(bobSeed)
+	spk, opk := newKey(), newKey()
+	alice, err := newInitiatorSession(aliceId, &signalBundle{
+		IdentityKey:    bobId.PublicKey().Bytes(),
+		SignedPreKeyId: 7,
+		SignedPreKey:   spk.PublicKey().Bytes(),
+		Signature:      xeddsaSign(bobSeed, serializeKey(spk.PublicKey().Bytes())),
+		PreKeyId:       3,
+		PreKey:         opk.PublicKey().Bytes(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alicePub, bobPub := aliceId.PublicKey().Bytes(), bobId.PublicKey().Bytes()
+
+	var sent []*signalPreKeyMessage
+	for i := 0; i < 4; i++ {
+		m, preKey, err := alice.encrypt(alicePub, 99, []byte{byte(i)})
+		if err != nil || !preKey {
+			t.Fatalf("message %d: prekey %v, %v", i, preKey, err)
+		}
+		pm, err := parsePreKeyMessage(m)
+		if err != nil || pm.preKeyId != 3 || !pm.hasPreKey || pm.signedPreKeyId != 7 || pm.registrationId != 99 {
+			t.Fatalf("message %d: parsed %+v, %v", i, pm, err)
+		}
+		sent = append(sent, pm)
+	}
+	bob, err := newResponderSession(bobId, spk, opk, sent[0].identityKey, sent[0].baseKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Message 2 never arrives.
+	for _, i := range []int{3, 0, 1} {
+		if got, err := bob.decrypt(bobPub, sent[i].message); err != nil || !bytes.Equal(got, []byte{byte(i)}) {
+			t.Errorf("message %d: got %v, %v", i, got, err)
+		}
+	}
+	if _, err := bob.decrypt(bobPub, sent[0].message); err != errSignalReplay {
+		t.Errorf("replay: %v", err)
+	}
+
+	// Replies advance the ratchet; messages of a step arrive out of order.
+	for round := 0; round < 3; round++ {
+		var replies [][]byte
+		for i := 0; i < 3; i++ {
+			m, preKey, err := bob.encrypt(bobPub, 1, []byte{byte(round), byte(i)})
+			if err != nil || preKey {
+				t.Fatalf("round %d: prekey %v, %v", round, preKey, err)
+			}
+			replies = append(replies, m)
+		}
+		for _, i := range []int{2, 0, 1} {
+			if got, err := alice.decrypt(alicePub, replies[i]); err != nil || !bytes.Equal(got, []byte{byte(round), byte(i)}) {
+				t.Errorf("round %d, reply %d: got %v, %v", round, i, got, err)
+			}
+		}
+		m, preKey, err := alice.encrypt(alicePub, 99, []byte("back"))
+		if err != nil || preKey {
+			t.Fatalf("round %d: prekey %v after a reply, %v", round, preKey, err)
+		}
+		// Failed decryption spoils the session, which is only stored on
+		// success, so a copy tries the tampered message.
+		tampered := append([]byte(nil), m...)
+		tampered[len(tampered)-1] ^= 1
+		if _, err := copySession(t, bob).decrypt(bobPub, tampered); err != errSignalMAC {
+			t.Errorf("round %d: tampered message: %v", round, err)
+		}
+		if got, err := bob.decrypt(bobPub, m); err != nil || string(got) != "back" {
+			t.Errorf("round %d: got %q, %v", round, got, err)
+		}
+	}
+
+	// The skipped message still decrypts after the ratchet moved on.
+	if got, err := bob.decrypt(bobPub, sent[2].message); err != nil || !bytes.Equal(got, []byte{2}) {
+		t.Errorf("skipped message: got %v, %v", got, err)
+	}
+}
+
+func copySession(t *testing.T, s *signalSession) *signalSession {
+	t.Helper()
+	raw, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := new(signalSession)
+	if err = json.Unmarshal(raw, c); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// pepService is the PEP service of the server, which also records the
+// messages sent, and holds back those of a while hold is set.
+type pepService struct {
+	mu    sync.Mutex
+	nodes map[string]string
+	raw   strings.Builder
+	hold  bool
+	held  []string
+	inner map[string]string
+	start map[string]xml.StartElement
+}
+
+func newPEPService() *pepService {
+	return &pepService{
+		nodes: make(map[string]string),
+		inner: make(map[string]string),
+		start: make(map[string]xml.StartElement),
+	}
+}
+
+func (p *pepService) route(from *fakeServer, stanza xml.StartElement, inner string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if stanza.Name.Local == "message" {
+		p.raw.WriteString(inner)
+		if p.hold && from.c.Jid == "a@example.com/r" {
+			id := attr(stanza, "id")
+			p.held = append(p.held, id)
+			p.start[id], p.inner[id] = stanza, inner
+			return true
+		}
+		return false
+	}
+	if stanza.Name.Local != "iq" || !strings.Contains(inner, nsPubSub) {
+		return false
+	}
+	var query struct {
+		Publish *struct {
+			Node string `xml:"node,attr"`
+			Item struct {
+				Inner string `xml:",innerxml"`
+			} `xml:"item"`
+		} `xml:"publish"`
+		Items *struct {
+			Node string `xml:"node,attr"`
+		} `xml:"items"`
+	}
+	xml.Unmarshal([]byte(inner), &query)
+	owner := attr(stanza, "to")
+	if owner == "" {
+		owner = RemoveResourceFromJid(from.c.Jid)
+	}
+	id := xmlEscape(attr(stanza, "id"))
+	var reply string
+	switch {
+	case query.Publish != nil:
+		p.nodes[owner+" "+query.Publish.Node] = query.Publish.Item.Inner
+		reply = "<iq type='result' id='" + id + "'/>"
+	case query.Items != nil && owner == "broken.example.com":
+		reply = "<iq type='error' id='" + id + "' from='" + owner + "'><error type='wait'><internal-server-error xmlns='" + nsStanzas + "'/></error></iq>"
+	case query.Items != nil && p.nodes[owner+" "+query.Items.Node] != "":
+		item := p.nodes[owner+" "+query.Items.Node]
+		reply = "<iq type='result' id='" + id + "' from='" + owner + "'><pubsub xmlns='" + nsPubSub + "'><items node='" + xmlEscape(query.Items.Node) + "'><item id='current'>" + item + "</item></items></pubsub></iq>"
+	default:
+		reply = "<iq type='error' id='" + id + "' from='" + owner + "'><error type='cancel'><item-not-found xmlns='" + nsStanzas + "'/></error></iq>"
+	}
+	go from.srv.Write([]byte(reply))
+	return true
+}
+
+func (p *pepService) published() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.nodes)
+}
+
+type omemoRecorder struct {
+	msgs chan *ClientMessage
+}
+
+func (h *omemoRecorder) RecvMsg(msg *ClientMessage) {
+	h.msgs <- msg
+}
+
+func (h *omemoRecorder) RecvPresence(pres *ClientPresence) {}
+
+func (h *omemoRecorder) next(t *testing.T) *ClientMessage {
+	t.Helper()
+	select {
+	case msg := <-h.msgs:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message")
+		return nil
+	}
+}
+
+func TestOMEMO(t *testing.T) {
+	pep := newPEPService()
+	var askedMu sync.Mutex
+	var asked []OMEMODevice
+	configA := &Config{OMEMO: &OMEMOConfig{}}
+	configB := &Config{OMEMO: &OMEMOConfig{AllowPlaintext: true, Trust: func(d OMEMODevice) bool {
+		askedMu.Lock()
+		asked = append(asked, d)
+		askedMu.Unlock()
+		return true
+	}}}
+	a, b := link(t, configA, configB, pep.route)
+	ha := &omemoRecorder{msgs: make(chan *ClientMessage, 10)}
+	hb := &omemoRecorder{msgs: make(chan *ClientMessage, 10)}
+	a.c.Handler, b.c.Handler = ha, hb
+	go a.c.Listen()
+	go b.c.Listen()
+
+	// Device lists and bundles of both.
+	for deadline := time.Now().Add(5 * time.Second); pep.published() < 4; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d PEP nodes published, want 4", pep.published())
+		}
+	}
+
+	if err := a.c.Send("b@example.com", "first secret"); err != nil {
+		t.Fatal(err)
+	}
+	if msg := hb.next(t); msg.Body != "first secret" || msg.OMEMOError != nil || msg.OMEMOSender == nil || !msg.OMEMOSender.Trusted {
+		t.Fatalf("got %q, %v from %+v", msg.Body, msg.OMEMOError, msg.OMEMOSender)
+	}
+
+	// Messages arrive out of order, one of them late and twice.
+	pep.mu.Lock()
+	pep.hold = true
+	pep.mu.Unlock()
+	secrets := []string{"second secret", "third secret", "fourth secret"}
+	for _, secret := range secrets {
+		if err := a.c.Send("b@example.com", secret); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		pep.mu.Lock()
+		n := len(pep.held)
+		pep.mu.Unlock()
+		if n == len(secrets) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d messages sent, want %d", n, len(secrets))
+		}
+	}
+	pep.mu.Lock()
+	pep.hold = false
+	pep.mu.Unlock()
+	for _, i := range []int{2, 0, 1, 1} {
+		id := pep.held[i]
+		if err := b.deliver(a, pep.start[id], pep.inner[id]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, i := range []int{2, 0, 1} {
+		if msg := hb.next(t); msg.Body != secrets[i] || msg.OMEMOError != nil {
+			t.Errorf("got %q, %v, want %q", msg.Body, msg.OMEMOError, secrets[i])
+		}
+	}
+	if msg := hb.next(t); msg.OMEMOError == nil || strings.Contains(msg.Body, "secret") {
+		t.Errorf("replayed message decrypted: %q", msg.Body)
+	}
+
+	// Replies from another goroutine are encrypted with the session a
+	// started.
+	if err := b.c.Send("a@example.com/r", "reply secret"); err != nil {
+		t.Fatal(err)
+	}
+	if msg := ha.next(t); msg.Body != "reply secret" || msg.OMEMOSender == nil || !msg.OMEMOSender.Trusted {
+		t.Errorf("got %q, %v from %+v", msg.Body, msg.OMEMOError, msg.OMEMOSender)
+	}
+
+	pep.mu.Lock()
+	raw := pep.raw.String()
+	pep.mu.Unlock()
+	if strings.Contains(raw, "secret") || !strings.Contains(raw, omemoFallback) {
+		t.Errorf("sent %s", raw)
+	}
+	fingerprint, err := a.c.OMEMOFingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	askedMu.Lock()
+	if len(asked) != 1 || asked[0].Jid != "a@example.com" || asked[0].Fingerprint() != fingerprint {
+		t.Errorf("trust asked for %+v, want once for %s", asked, fingerprint)
+	}
+	askedMu.Unlock()
+
+	if _, err := a.c.SendMessage("b@example.com", "secret", "chat", WithSubject("", "subject")); err != ErrOMEMOPlaintext {
+		t.Errorf("sending a subject: %v, want ErrOMEMOPlaintext", err)
+	}
+	if _, err := a.c.React("b@example.com", "chat", "id", "👍"); err != ErrOMEMOPlaintext {
+		t.Errorf("reacting: %v, want ErrOMEMOPlaintext", err)
+	}
+	if err := a.c.Send("nobody@example.com", "secret"); err != ErrOMEMONoDevices {
+		t.Errorf("sending to nobody: %v, want ErrOMEMONoDevices", err)
+	}
+	if err := b.c.Send("nobody@example.com", "hello"); err != nil {
+		t.Errorf("sending to nobody in plaintext: %v", err)
+	}
+	if err := a.c.Send("broken.example.com", "secret"); err == nil {
+		t.Error("sent to a JID whose devices could not be fetched")
+	}
+	if err := b.c.Send("broken.example.com", "hello"); err != nil {
+		t.Errorf("sending in plaintext after a failed fetch: %v", err)
+	}
+
+	// Occupants are not looked up, even when the room has devices.
+	pep.mu.Lock()
+	pep.nodes["room@conference.example.com "+nodeOMEMODevices] = "<list xmlns='" + nsOMEMO + "'><device id='1'/></list>"
+	pep.mu.Unlock()
+	if err := a.c.JoinMUC("room@conference.example.com", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.c.Send("room@conference.example.com/b", "secret"); err != ErrOMEMONoDevices {
+		t.Errorf("sending to an occupant: %v, want ErrOMEMONoDevices", err)
+	}
+
+	// Bodies from devices no longer trusted are withheld.
+	devices, err := b.c.OMEMODevices("a@example.com")
+	if err != nil || len(devices) != 1 {
+		t.Fatalf("devices of a: %v, %v", devices, err)
+	}
+	if err := b.c.SetOMEMOTrust("a@example.com", devices[0].Id, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.c.Send("b@example.com", "last secret"); err != nil {
+		t.Fatal(err)
+	}
+	if msg := hb.next(t); msg.Body != omemoFallback || msg.OMEMOError != ErrOMEMOUntrustedSender || msg.OMEMOSender == nil || msg.OMEMOSender.Trusted {
+		t.Errorf("got %q, %v from %+v", msg.Body, msg.OMEMOError, msg.OMEMOSender)
+	}
+}
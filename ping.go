@@ -0,0 +1,63 @@
+package xmppclient
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// XMPP Ping, XEP-0199
+// http://xmpp.org/extensions/xep-0199.html
+
+// ErrKeepAliveTimeout is reported by Err when the server stopped answering
+// keepalive pings.
+var ErrKeepAliveTimeout = errors.New("xmpp: keepalive: server stopped answering pings")
+
+// Ping sends a ping to jid and returns the round-trip time. An error reply,
+// such as service-unavailable from an entity that does not support pings, is
+// returned along with the round-trip time, since it still proves the path
+// works.
+//
+//	<iq to='capulet.lit' id='c2s1' type='get'>
+//	  <ping xmlns='urn:xmpp:ping'/>
+//	</iq>
+func (c *Conn) Ping(ctx context.Context, jid string) (time.Duration, error) {
+	start := time.Now()
+	_, err := c.sendIQ(ctx, jid, "get", "<ping xmlns='"+nsPing+"'/>")
+	return time.Since(start), err
+}
+
+// keepAliveLoop pings the server until the connection stops being read, or
+// closes it after too many missed pongs.
+func (c *Conn) keepAliveLoop() {
+	ticker := time.NewTicker(c.keepAlive)
+	defer ticker.Stop()
+
+	misses := 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), c.keepAlive)
+		_, err := c.Ping(ctx, c.Domain)
+		cancel()
+		switch err.(type) {
+		case nil, *ClientError:
+			misses = 0
+			continue
+		}
+		if err == ErrClosed {
+			return
+		}
+
+		misses++
+		if misses >= c.keepAliveMisses {
+			c.setErr(ErrKeepAliveTimeout)
+			c.Close()
+			return
+		}
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/xml"
 	"errors"
+	"strings"
+	"time"
 )
 
 const (
@@ -12,11 +14,60 @@ const (
 	nsSASL    = "urn:ietf:params:xml:ns:xmpp-sasl"
 	nsBind    = "urn:ietf:params:xml:ns:xmpp-bind"
 	nsSession = "urn:ietf:params:xml:ns:xmpp-session"
+	nsStanzas = "urn:ietf:params:xml:ns:xmpp-stanzas"
 
 	nsClient = "jabber:client"
 
 	nsConference = "jabber:x:conference"
 	nsRoster     = "jabber:iq:roster"
+	nsVersion    = "jabber:iq:version"
+
+	nsPing     = "urn:xmpp:ping"
+	nsReceipts = "urn:xmpp:receipts"
+	nsMarkers  = "urn:xmpp:chat-markers:0"
+
+	nsChatStates = "http://jabber.org/protocol/chatstates"
+	nsSid        = "urn:xmpp:sid:0"
+
+	nsMam     = "urn:xmpp:mam:2"
+	nsRSM     = "http://jabber.org/protocol/rsm"
+	nsForward = "urn:xmpp:forward:0"
+	nsCarbons = "urn:xmpp:carbons:2"
+	nsDelay   = "urn:xmpp:delay"
+
+	nsLegacyDelay = "jabber:x:delay"
+	nsCorrect     = "urn:xmpp:message-correct:0"
+	nsRetract     = "urn:xmpp:message-retract:1"
+	nsModerate    = "urn:xmpp:message-moderate:1"
+	nsFallback    = "urn:xmpp:fallback:0"
+	nsHints       = "urn:xmpp:hints"
+	nsReactions   = "urn:xmpp:reactions:0"
+	nsReply       = "urn:xmpp:reply:0"
+	nsOOB         = "jabber:x:oob"
+	nsUpload      = "urn:xmpp:http:upload:0"
+	nsIBB         = "http://jabber.org/protocol/ibb"
+	nsBytestreams = "http://jabber.org/protocol/bytestreams"
+	nsJingle      = "urn:xmpp:jingle:1"
+	nsJingleFT    = "urn:xmpp:jingle:apps:file-transfer:5"
+	nsJingleIBB   = "urn:xmpp:jingle:transports:ibb:1"
+	nsJingleS5B   = "urn:xmpp:jingle:transports:s5b:1"
+	nsBlocking    = "urn:xmpp:blocking"
+	nsReporting   = "urn:xmpp:reporting:1"
+	nsOffline     = "http://jabber.org/protocol/offline"
+	nsStyling     = "urn:xmpp:styling:0"
+	nsXHTMLIM     = "http://jabber.org/protocol/xhtml-im"
+	nsXHTML       = "http://www.w3.org/1999/xhtml"
+	nsOMEMO       = "eu.siacs.conversations.axolotl"
+	nsEME         = "urn:xmpp:eme:0"
+	nsPubSub      = "http://jabber.org/protocol/pubsub"
+	nsPubSubEvent = "http://jabber.org/protocol/pubsub#event"
+
+	nsPubSubPublishOptions = "http://jabber.org/protocol/pubsub#publish-options"
+
+	nsCaps       = "http://jabber.org/protocol/caps"
+	nsDiscoInfo  = "http://jabber.org/protocol/disco#info"
+	nsDiscoItems = "http://jabber.org/protocol/disco#items"
+	nsData       = "jabber:x:data"
 
 	nsMuc      = "http://jabber.org/protocol/muc"
 	nsMucUser  = "http://jabber.org/protocol/muc#user"
@@ -128,17 +179,70 @@ type ClientMessage struct {
 	Id      string   `xml:"id,attr"`
 	To      string   `xml:"to,attr"`
 	Type    string   `xml:"type,attr"` // chat, error, groupchat, headline, or normal
+	Lang    string   `xml:"lang,attr"`
 
-	// These should technically be []clientText,
-	// but string is much more convenient.
-	Subject string `xml:"subject"`
-	Body    string `xml:"body"`
-	Thread  string `xml:"thread"`
+	// Subject, Body and Thread are the default language subject and body,
+	// and the thread id, for convenience. All languages are in Subjects and
+	// Bodies, see BodyFor.
+	Subject      string `xml:"-"`
+	Body         string `xml:"-"`
+	Thread       string `xml:"-"`
+	ThreadParent string `xml:"-"`
+
+	Subjects   []ClientText  `xml:"subject"`
+	Bodies     []ClientText  `xml:"body"`
+	ThreadElem *ClientThread `xml:"thread"`
 
 	Active      *Active
 	Composing   *Composing
 	Paused      *Paused
-	ConferenceX *ConferenceX `xml:"x"`
+	Inactive    *Inactive
+	Gone        *Gone
+	ConferenceX *ConferenceX `xml:"jabber:x:conference x"`
+
+	ReceiptRequest *ReceiptRequest
+	Received       *Received
+
+	OriginId  *OriginId
+	StanzaIds []StanzaId `xml:"urn:xmpp:sid:0 stanza-id"`
+
+	ArchiveResult *ArchiveResult
+	Forwarded     *Forwarded
+
+	Delay       *Delay       `xml:"urn:xmpp:delay delay"`
+	LegacyDelay *LegacyDelay `xml:"jabber:x:delay x"`
+
+	Replace   *Replace
+	Retract   *Retract
+	Reactions *Reactions
+	Reply     *Reply
+	Fallbacks []Fallback `xml:"urn:xmpp:fallback:0 fallback"`
+	OOB       *OOB
+	IBBData   *IBBData
+	Offline   *Offline
+	Unstyled  *Unstyled
+	XHTML     *XHTMLIM
+	OMEMO     *OMEMOEncrypted
+	Event     *PubSubEvent
+
+	// OMEMOSender is set on OMEMO messages whose body was decrypted: the
+	// device that sent it. OMEMOError tells why decryption failed, or is
+	// ErrOMEMOUntrustedSender when the body of an untrusted OMEMOSender
+	// was withheld, leaving the fallback body.
+	OMEMOSender *OMEMODevice `xml:"-"`
+	OMEMOError  error        `xml:"-"`
+
+	CarbonSent     *CarbonCopy `xml:"urn:xmpp:carbons:2 sent"`
+	CarbonReceived *CarbonCopy `xml:"urn:xmpp:carbons:2 received"`
+	// Carbon is set on messages unwrapped from a carbon copy: CarbonSent
+	// when another of our resources sent the message, CarbonReceived when
+	// it received it.
+	Carbon string `xml:"-"`
+
+	Markable           *Markable
+	ReceivedMarker     *ChatMarker `xml:"urn:xmpp:chat-markers:0 received"`
+	DisplayedMarker    *ChatMarker `xml:"urn:xmpp:chat-markers:0 displayed"`
+	AcknowledgedMarker *ChatMarker `xml:"urn:xmpp:chat-markers:0 acknowledged"`
 }
 
 type Active struct {
@@ -153,8 +257,424 @@ type Paused struct {
 	XMLName xml.Name `xml:"http://jabber.org/protocol/chatstates paused"`
 }
 
+type Inactive struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/chatstates inactive"`
+}
+
+type Gone struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/chatstates gone"`
+}
+
+// OriginId is the id the sender assigned to a message. See
+// http://xmpp.org/extensions/xep-0359.html
+type OriginId struct {
+	XMLName xml.Name `xml:"urn:xmpp:sid:0 origin-id"`
+	Id      string   `xml:"id,attr"`
+}
+
+// StanzaId is the id an archiving entity, named by By, assigned to a message.
+type StanzaId struct {
+	XMLName xml.Name `xml:"urn:xmpp:sid:0 stanza-id"`
+	Id      string   `xml:"id,attr"`
+	By      string   `xml:"by,attr"`
+}
+
+// Forwarded wraps a message forwarded by another entity, with the time it was
+// originally sent. See http://xmpp.org/extensions/xep-0297.html
+type Forwarded struct {
+	XMLName xml.Name       `xml:"urn:xmpp:forward:0 forwarded"`
+	Delay   *Delay         `xml:"urn:xmpp:delay delay"`
+	Message *ClientMessage `xml:"jabber:client message"`
+}
+
+// Delayed returns when the forwarded message was originally sent, or
+// archived, and the JID of the entity that recorded it.
+func (f *Forwarded) Delayed() (stamp time.Time, from string, ok bool) {
+	return delayed(f.Delay, nil)
+}
+
+// Delay tells when, and optionally by whom, a stanza was originally sent or
+// stored. See http://xmpp.org/extensions/xep-0203.html
+type Delay struct {
+	From  string `xml:"from,attr"`
+	Stamp string `xml:"stamp,attr"` // XEP-0082 DateTime
+	Text  string `xml:",chardata"`
+}
+
+// Time returns the stamp, or false when it is not a valid DateTime.
+func (d *Delay) Time() (time.Time, bool) {
+	t, err := time.Parse(time.RFC3339, d.Stamp)
+	return t, err == nil
+}
+
+// CarbonCopy wraps a message sent or received by another of our resources.
+// See http://xmpp.org/extensions/xep-0280.html
+type CarbonCopy struct {
+	Forwarded Forwarded `xml:"urn:xmpp:forward:0 forwarded"`
+}
+
+// Replace marks a message as the correction of the earlier message with the
+// given id. See http://xmpp.org/extensions/xep-0308.html
+type Replace struct {
+	XMLName xml.Name `xml:"urn:xmpp:message-correct:0 replace"`
+	Id      string   `xml:"id,attr"`
+}
+
+// Retract asks recipients to remove the earlier message with the given id
+// (its origin-id, or the room's stanza-id in groupchat). Moderated is set
+// when a room moderator removed somebody else's message. See
+// http://xmpp.org/extensions/xep-0424.html and
+// http://xmpp.org/extensions/xep-0425.html
+type Retract struct {
+	XMLName   xml.Name   `xml:"urn:xmpp:message-retract:1 retract"`
+	Id        string     `xml:"id,attr"`
+	Reason    string     `xml:"reason"`
+	Moderated *Moderated `xml:"urn:xmpp:message-moderate:1 moderated"`
+}
+
+type Moderated struct {
+	By string `xml:"by,attr"`
+}
+
+// Reactions is the full set of reactions of the sender to the message with
+// the given id; an empty set removes earlier reactions. See
+// http://xmpp.org/extensions/xep-0444.html
+type Reactions struct {
+	XMLName   xml.Name `xml:"urn:xmpp:reactions:0 reactions"`
+	Id        string   `xml:"id,attr"`
+	Reactions []string `xml:"reaction"`
+}
+
+// Reply marks a message as a reply to the message with the given id, sent by
+// To. See http://xmpp.org/extensions/xep-0461.html
+type Reply struct {
+	XMLName xml.Name `xml:"urn:xmpp:reply:0 reply"`
+	To      string   `xml:"to,attr"`
+	Id      string   `xml:"id,attr"`
+}
+
+// Fallback marks parts of the body as only meant for clients not supporting
+// the specification For. Without Bodies the whole body is fallback. See
+// http://xmpp.org/extensions/xep-0428.html
+type Fallback struct {
+	For    string          `xml:"for,attr"`
+	Bodies []FallbackRange `xml:"body"`
+}
+
+// FallbackRange is a range of the body in unicode code points, End
+// excluded.
+type FallbackRange struct {
+	Start string `xml:"start,attr"`
+	End   string `xml:"end,attr"`
+}
+
+// OOB points to data available out of band, usually a file shared over HTTP.
+// See http://xmpp.org/extensions/xep-0066.html
+type OOB struct {
+	XMLName xml.Name `xml:"jabber:x:oob x"`
+	URL     string   `xml:"url"`
+	Desc    string   `xml:"desc"`
+}
+
+// IBBOpen, IBBData and IBBClose make up an in-band bytestream.
+// See http://xmpp.org/extensions/xep-0047.html
+type IBBOpen struct {
+	XMLName   xml.Name `xml:"http://jabber.org/protocol/ibb open"`
+	BlockSize int      `xml:"block-size,attr"`
+	Sid       string   `xml:"sid,attr"`
+	Stanza    string   `xml:"stanza,attr,omitempty"`
+}
+
+type IBBData struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/ibb data"`
+	Seq     string   `xml:"seq,attr"` // 0 to 65535, then wrapping around
+	Sid     string   `xml:"sid,attr"`
+	Data    string   `xml:",chardata"`
+}
+
+type IBBClose struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/ibb close"`
+	Sid     string   `xml:"sid,attr"`
+}
+
+// Bytestreams negotiates a SOCKS5 bytestream.
+// See http://xmpp.org/extensions/xep-0065.html
+type Bytestreams struct {
+	XMLName        xml.Name        `xml:"http://jabber.org/protocol/bytestreams query"`
+	Sid            string          `xml:"sid,attr,omitempty"`
+	Mode           string          `xml:"mode,attr,omitempty"`
+	StreamHosts    []StreamHost    `xml:"streamhost"`
+	StreamHostUsed *StreamHostUsed `xml:"streamhost-used"`
+	Activate       string          `xml:"activate,omitempty"`
+}
+
+// StreamHost is a SOCKS5 server a bytestream can be established through:
+// either the initiator itself or a proxy.
+type StreamHost struct {
+	Jid  string `xml:"jid,attr"`
+	Host string `xml:"host,attr"`
+	Port int    `xml:"port,attr"`
+}
+
+type StreamHostUsed struct {
+	Jid string `xml:"jid,attr"`
+}
+
+// Jingle negotiates a session with a peer.
+// See http://xmpp.org/extensions/xep-0166.html
+type Jingle struct {
+	XMLName   xml.Name        `xml:"urn:xmpp:jingle:1 jingle"`
+	Action    string          `xml:"action,attr"`
+	Initiator string          `xml:"initiator,attr,omitempty"`
+	Responder string          `xml:"responder,attr,omitempty"`
+	Sid       string          `xml:"sid,attr"`
+	Contents  []JingleContent `xml:"content"`
+	Reason    *JingleReason   `xml:"reason"`
+}
+
+type JingleContent struct {
+	Creator     string `xml:"creator,attr"`
+	Name        string `xml:"name,attr"`
+	Senders     string `xml:"senders,attr,omitempty"`
+	Description *FileTransferDescription
+	IBB         *JingleIBBTransport
+	S5B         *JingleS5BTransport
+}
+
+type JingleReason struct {
+	Condition xml.Name `xml:",any"`
+	Text      string   `xml:"text"`
+}
+
+// FileTransferDescription is the application of a Jingle file transfer.
+// See http://xmpp.org/extensions/xep-0234.html
+type FileTransferDescription struct {
+	XMLName xml.Name   `xml:"urn:xmpp:jingle:apps:file-transfer:5 description"`
+	File    JingleFile `xml:"file"`
+}
+
+// JingleFile describes a file offered over Jingle.
+type JingleFile struct {
+	MediaType string `xml:"media-type,omitempty"`
+	Name      string `xml:"name,omitempty"`
+	Size      int64  `xml:"size,omitempty"`
+	Desc      string `xml:"desc,omitempty"`
+}
+
+// JingleIBBTransport carries a Jingle session over an in-band bytestream.
+// See http://xmpp.org/extensions/xep-0261.html
+type JingleIBBTransport struct {
+	XMLName   xml.Name `xml:"urn:xmpp:jingle:transports:ibb:1 transport"`
+	BlockSize int      `xml:"block-size,attr"`
+	Sid       string   `xml:"sid,attr"`
+	Stanza    string   `xml:"stanza,attr,omitempty"`
+}
+
+// JingleS5BTransport carries a Jingle session over a SOCKS5 bytestream.
+// See http://xmpp.org/extensions/xep-0260.html
+type JingleS5BTransport struct {
+	XMLName        xml.Name            `xml:"urn:xmpp:jingle:transports:s5b:1 transport"`
+	Sid            string              `xml:"sid,attr"`
+	DstAddr        string              `xml:"dstaddr,attr,omitempty"`
+	Mode           string              `xml:"mode,attr,omitempty"`
+	Candidates     []JingleCandidate   `xml:"candidate"`
+	CandidateUsed  *JingleCandidateRef `xml:"candidate-used"`
+	CandidateError *struct{}           `xml:"candidate-error"`
+	Activated      *JingleCandidateRef `xml:"activated"`
+	ProxyError     *struct{}           `xml:"proxy-error"`
+}
+
+type JingleCandidate struct {
+	Cid      string `xml:"cid,attr"`
+	Host     string `xml:"host,attr"`
+	Jid      string `xml:"jid,attr"`
+	Port     int    `xml:"port,attr,omitempty"`
+	Priority uint32 `xml:"priority,attr"`
+	Type     string `xml:"type,attr,omitempty"` // assisted, direct, proxy or tunnel
+}
+
+type JingleCandidateRef struct {
+	Cid string `xml:"cid,attr"`
+}
+
+// BlockingCommand is a blocklist, block or unblock element of the blocking
+// command. See http://xmpp.org/extensions/xep-0191.html
+type BlockingCommand struct {
+	XMLName xml.Name
+	Items   []BlockItem `xml:"item"`
+}
+
+type BlockItem struct {
+	Jid string `xml:"jid,attr"`
+}
+
+// Offline marks a message retrieved from offline storage with the node it can
+// be fetched or removed by. See http://xmpp.org/extensions/xep-0013.html
+type Offline struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/offline offline"`
+	Item    struct {
+		Node string `xml:"node,attr"`
+	} `xml:"item"`
+}
+
+// Unstyled asks for the body to be shown as is, without message styling.
+// See http://xmpp.org/extensions/xep-0393.html
+type Unstyled struct {
+	XMLName xml.Name `xml:"urn:xmpp:styling:0 unstyled"`
+}
+
+// XHTMLIM carries rich text versions of the body. The markup is not
+// sanitized; see ClientMessage.HTML.
+// See http://xmpp.org/extensions/xep-0071.html
+type XHTMLIM struct {
+	XMLName xml.Name    `xml:"http://jabber.org/protocol/xhtml-im html"`
+	Bodies  []XHTMLBody `xml:"http://www.w3.org/1999/xhtml body"`
+}
+
+type XHTMLBody struct {
+	Lang  string `xml:"lang,attr"`
+	Inner string `xml:",innerxml"`
+}
+
+// OMEMOEncrypted is an OMEMO encrypted message: the payload, and the key to
+// it encrypted for each recipient device. Messages without a payload only
+// carry keys, to set up or advance sessions.
+// See http://xmpp.org/extensions/xep-0384.html
+type OMEMOEncrypted struct {
+	XMLName xml.Name    `xml:"eu.siacs.conversations.axolotl encrypted"`
+	Header  OMEMOHeader `xml:"header"`
+	Payload string      `xml:"payload,omitempty"`
+}
+
+type OMEMOHeader struct {
+	Sid  string     `xml:"sid,attr"` // sending device id
+	Keys []OMEMOKey `xml:"key"`
+	IV   string     `xml:"iv"`
+}
+
+type OMEMOKey struct {
+	Rid    string `xml:"rid,attr"` // receiving device id
+	PreKey string `xml:"prekey,attr,omitempty"`
+	Value  string `xml:",chardata"`
+}
+
+// IsPreKey reports whether the key starts a session.
+func (k *OMEMOKey) IsPreKey() bool {
+	return k.PreKey == "true" || k.PreKey == "1"
+}
+
+type OMEMODeviceList struct {
+	XMLName xml.Name `xml:"eu.siacs.conversations.axolotl list"`
+	Devices []struct {
+		Id uint32 `xml:"id,attr"`
+	} `xml:"device"`
+}
+
+type OMEMOBundle struct {
+	XMLName      xml.Name            `xml:"eu.siacs.conversations.axolotl bundle"`
+	SignedPreKey OMEMOPreKeyPublic   `xml:"signedPreKeyPublic"`
+	Signature    string              `xml:"signedPreKeySignature"`
+	IdentityKey  string              `xml:"identityKey"`
+	PreKeys      []OMEMOPreKeyPublic `xml:"prekeys>preKeyPublic"`
+}
+
+type OMEMOPreKeyPublic struct {
+	PreKeyId       uint32 `xml:"preKeyId,attr"`
+	SignedPreKeyId uint32 `xml:"signedPreKeyId,attr"`
+	Key            string `xml:",chardata"`
+}
+
+// PubSub is the payload of publish-subscribe (XEP-0060) requests, used here
+// to fetch personal eventing (XEP-0163) items.
+type PubSub struct {
+	XMLName xml.Name    `xml:"http://jabber.org/protocol/pubsub pubsub"`
+	Items   PubSubItems `xml:"items"`
+}
+
+type PubSubItems struct {
+	Node  string       `xml:"node,attr"`
+	Items []PubSubItem `xml:"item"`
+}
+
+type PubSubItem struct {
+	Id    string `xml:"id,attr"`
+	Inner []byte `xml:",innerxml"`
+}
+
+// PubSubEvent notifies subscribers of published items.
+type PubSubEvent struct {
+	XMLName xml.Name     `xml:"http://jabber.org/protocol/pubsub#event event"`
+	Items   *PubSubItems `xml:"items"`
+}
+
+// LegacyDelay is the obsolete XEP-0091 form of Delay, still sent by some
+// servers. See http://xmpp.org/extensions/xep-0091.html
+type LegacyDelay struct {
+	XMLName xml.Name `xml:"jabber:x:delay x"`
+	From    string   `xml:"from,attr"`
+	Stamp   string   `xml:"stamp,attr"` // CCYYMMDDThh:mm:ss in UTC
+}
+
+// delayed returns the original send time and sender recorded by delay or,
+// failing that, legacy.
+func delayed(delay *Delay, legacy *LegacyDelay) (stamp time.Time, from string, ok bool) {
+	if delay != nil {
+		if t, ok := delay.Time(); ok {
+			return t, delay.From, true
+		}
+	}
+	if legacy != nil {
+		if t, err := time.Parse("20060102T15:04:05", legacy.Stamp); err == nil {
+			return t, legacy.From, true
+		}
+	}
+	return time.Time{}, "", false
+}
+
+// ArchiveResult carries one message of a message archive query.
+type ArchiveResult struct {
+	XMLName   xml.Name  `xml:"urn:xmpp:mam:2 result"`
+	QueryId   string    `xml:"queryid,attr"`
+	Id        string    `xml:"id,attr"`
+	Forwarded Forwarded `xml:"urn:xmpp:forward:0 forwarded"`
+}
+
+// ResultSet controls and reports the paging of a result set. See
+// http://xmpp.org/extensions/xep-0059.html
+type ResultSet struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/rsm set"`
+	First   string   `xml:"first"`
+	Last    string   `xml:"last"`
+	Count   int      `xml:"count"`
+}
+
+// ReceiptRequest asks the recipient to acknowledge delivery. See
+// http://xmpp.org/extensions/xep-0184.html
+type ReceiptRequest struct {
+	XMLName xml.Name `xml:"urn:xmpp:receipts request"`
+}
+
+// Received acknowledges delivery of the message with the given id.
+type Received struct {
+	XMLName xml.Name `xml:"urn:xmpp:receipts received"`
+	Id      string   `xml:"id,attr"`
+}
+
+// Markable tells the recipient it may send chat markers for the message. See
+// http://xmpp.org/extensions/xep-0333.html
+type Markable struct {
+	XMLName xml.Name `xml:"urn:xmpp:chat-markers:0 markable"`
+}
+
+// ChatMarker marks the message with the given id, and all earlier ones, as
+// received, displayed or acknowledged; XMLName.Local tells which.
+type ChatMarker struct {
+	XMLName xml.Name
+	Id      string `xml:"id,attr"`
+}
+
 type ConferenceX struct {
-	XMLName xml.Name `xml:"jabber:x:conference x`
+	XMLName xml.Name `xml:"jabber:x:conference x"`
 	Jid     string   `xml:"jid,attr"`
 	Reason  string   `xml:"reason,attr"`
 }
@@ -164,6 +684,107 @@ type ClientText struct {
 	Body string `xml:",chardata"`
 }
 
+// ClientThread identifies the conversation thread of a message, and the
+// thread it was spawned from.
+type ClientThread struct {
+	Parent string `xml:"parent,attr"`
+	Id     string `xml:",chardata"`
+}
+
+// UnmarshalXML fills the convenience fields Subject, Body, Thread and
+// ThreadParent after decoding the message.
+func (this *ClientMessage) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type plain ClientMessage
+	if err := d.DecodeElement((*plain)(this), &start); err != nil {
+		return err
+	}
+	this.Subject = bestText(this.Subjects, this.Lang, nil)
+	this.Body = bestText(this.Bodies, this.Lang, nil)
+	if this.ThreadElem != nil {
+		this.Thread = this.ThreadElem.Id
+		this.ThreadParent = this.ThreadElem.Parent
+	}
+	return nil
+}
+
+// inheritLang gives the message, and the messages it forwards, the language
+// lang unless they declare their own, as xml:lang is inherited, and picks
+// Subject and Body again accordingly.
+func (this *ClientMessage) inheritLang(lang string) {
+	if this.Lang == "" && lang != "" {
+		this.Lang = lang
+		this.Subject = bestText(this.Subjects, this.Lang, nil)
+		this.Body = bestText(this.Bodies, this.Lang, nil)
+	}
+	forwarded := []*Forwarded{this.Forwarded}
+	if this.ArchiveResult != nil {
+		forwarded = append(forwarded, &this.ArchiveResult.Forwarded)
+	}
+	if this.CarbonSent != nil {
+		forwarded = append(forwarded, &this.CarbonSent.Forwarded)
+	}
+	if this.CarbonReceived != nil {
+		forwarded = append(forwarded, &this.CarbonReceived.Forwarded)
+	}
+	for _, f := range forwarded {
+		if f != nil && f.Message != nil {
+			f.Message.inheritLang(this.Lang)
+		}
+	}
+}
+
+// BodyFor returns the body best matching the preferred languages, in order
+// of preference, falling back to the default body.
+func (this *ClientMessage) BodyFor(langs ...string) string {
+	return bestText(this.Bodies, this.Lang, langs)
+}
+
+// SubjectFor returns the subject best matching the preferred languages.
+func (this *ClientMessage) SubjectFor(langs ...string) string {
+	return bestText(this.Subjects, this.Lang, langs)
+}
+
+// bestText picks from texts, whose language defaults to lang, the one
+// matching the first possible of langs: exactly, or else by primary
+// language, so that "en" and "en-GB" match each other. Without a match, the
+// text in the default language, or else the first one, is returned.
+func bestText(texts []ClientText, lang string, langs []string) string {
+	if len(texts) == 0 {
+		return ""
+	}
+	textLang := func(t ClientText) string {
+		if t.Lang == "" {
+			return lang
+		}
+		return t.Lang
+	}
+	primary := func(l string) string {
+		if i := strings.IndexByte(l, '-'); i != -1 {
+			return l[:i]
+		}
+		return l
+	}
+
+	for _, want := range langs {
+		for _, t := range texts {
+			if strings.EqualFold(textLang(t), want) {
+				return t.Body
+			}
+		}
+		for _, t := range texts {
+			if strings.EqualFold(primary(textLang(t)), primary(want)) {
+				return t.Body
+			}
+		}
+	}
+	for _, t := range texts {
+		if t.Lang == "" || strings.EqualFold(t.Lang, lang) {
+			return t.Body
+		}
+	}
+	return texts[0].Body
+}
+
 func (this *ClientMessage) IsComposing() bool {
 	if this.Composing != nil {
 		return true
@@ -171,6 +792,65 @@ func (this *ClientMessage) IsComposing() bool {
 	return false
 }
 
+// StanzaId returns the id assigned to the message by the entity by, which
+// should be our own bare JID for messages archived by our server and the room
+// JID for groupchat. Ids claimed by anybody else cannot be trusted.
+func (this *ClientMessage) StanzaId(by string) string {
+	for _, sid := range this.StanzaIds {
+		if sid.By == by {
+			return sid.Id
+		}
+	}
+	return ""
+}
+
+// OriginalId returns the id the sender assigned to the message, preferring
+// the origin-id over the id attribute, which some servers rewrite.
+func (this *ClientMessage) OriginalId() string {
+	if this.OriginId != nil && this.OriginId.Id != "" {
+		return this.OriginId.Id
+	}
+	return this.Id
+}
+
+// Delayed returns when the message was originally sent and the JID of the
+// entity that delayed it, if it carries delayed delivery information, as
+// offline messages do.
+func (this *ClientMessage) Delayed() (stamp time.Time, from string, ok bool) {
+	return delayed(this.Delay, this.LegacyDelay)
+}
+
+// ChatState returns the chat state notification carried by the message, one
+// of the ChatState constants, or "" if there is none.
+func (this *ClientMessage) ChatState() string {
+	switch {
+	case this.Active != nil:
+		return ChatStateActive
+	case this.Composing != nil:
+		return ChatStateComposing
+	case this.Paused != nil:
+		return ChatStatePaused
+	case this.Inactive != nil:
+		return ChatStateInactive
+	case this.Gone != nil:
+		return ChatStateGone
+	}
+	return ""
+}
+
+// ChatMarker returns the chat marker carried by the message, or nil.
+func (this *ClientMessage) ChatMarker() *ChatMarker {
+	switch {
+	case this.AcknowledgedMarker != nil:
+		return this.AcknowledgedMarker
+	case this.DisplayedMarker != nil:
+		return this.DisplayedMarker
+	case this.ReceivedMarker != nil:
+		return this.ReceivedMarker
+	}
+	return nil
+}
+
 type ClientPresence struct {
 	XMLName xml.Name `xml:"jabber:client presence"`
 	From    string   `xml:"from,attr"`
@@ -183,17 +863,25 @@ type ClientPresence struct {
 	Status   string `xml:"status"` // sb []clientText
 	Priority string `xml:"priority"`
 	C        PresenceC
-	X        PresenceX    `xml:"x"`
+	X        PresenceX    `xml:"http://jabber.org/protocol/muc#user x"`
 	Error    *ClientError `xml:"error"`
+
+	Delay       *Delay       `xml:"urn:xmpp:delay delay"`
+	LegacyDelay *LegacyDelay `xml:"jabber:x:delay x"`
 }
 
+// PresenceC is the entity capabilities element attached to presence. See
+// http://xmpp.org/extensions/xep-0115.html
 type PresenceC struct {
 	XMLName xml.Name `xml:"http://jabber.org/protocol/caps c"`
+	Hash    string   `xml:"hash,attr"`
 	Node    string   `xml:"node,attr"`
+	Ver     string   `xml:"ver,attr"`
+	Ext     string   `xml:"ext,attr"` // legacy, pre-1.5 clients only
 }
 
 type PresenceX struct {
-	XMLName xml.Name        `xml:"jabber:client x`
+	XMLName xml.Name        `xml:"http://jabber.org/protocol/muc#user x"`
 	Item    MucPresenceItem `xml:"item"`
 }
 
@@ -210,6 +898,12 @@ func (this *ClientPresence) IsMUC() bool {
 	return false
 }
 
+// Delayed returns when the presence was originally sent and the JID of the
+// entity that delayed it, if it carries delayed delivery information.
+func (this *ClientPresence) Delayed() (stamp time.Time, from string, ok bool) {
+	return delayed(this.Delay, this.LegacyDelay)
+}
+
 func (this *ClientPresence) IsOnline() bool {
 	if this.Type == "" {
 		return true
@@ -231,6 +925,15 @@ func (this *ClientPresence) HasNode() bool {
 	return false
 }
 
+// HasCaps reports whether the presence carries a hashed (XEP-0115 v1.5+)
+// capabilities verification string.
+func (this *ClientPresence) HasCaps() bool {
+	if this.C.Hash != "" && this.C.Ver != "" {
+		return true
+	}
+	return false
+}
+
 type ClientIQ struct { // info/query
 	XMLName xml.Name    `xml:"jabber:client iq"`
 	From    string      `xml:"from,attr"`
@@ -319,16 +1022,19 @@ func next(p *xml.Decoder) (xml.Name, interface{}, error) {
 }
 
 type DiscoveryReply struct {
-	XMLName    xml.Name `xml:"http://jabber.org/protocol/disco#info query"`
-	Identities []DiscoveryIdentity
-	Features   []DiscoveryFeature
+	XMLName    xml.Name            `xml:"http://jabber.org/protocol/disco#info query"`
+	Node       string              `xml:"node,attr,omitempty"`
+	Identities []DiscoveryIdentity `xml:"identity"`
+	Features   []DiscoveryFeature  `xml:"feature"`
+	Forms      []DataForm          `xml:"jabber:x:data x"` // XEP-0128 extended information
 }
 
 type DiscoveryIdentity struct {
 	XMLName  xml.Name `xml:"http://jabber.org/protocol/disco#info identity"`
 	Category string   `xml:"category,attr"`
 	Type     string   `xml:"type,attr"`
-	Name     string   `xml:"name,attr"`
+	Lang     string   `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+	Name     string   `xml:"name,attr,omitempty"`
 }
 
 type DiscoveryFeature struct {
@@ -336,6 +1042,54 @@ type DiscoveryFeature struct {
 	Var     string   `xml:"var,attr"`
 }
 
+type DiscoveryItems struct {
+	XMLName xml.Name        `xml:"http://jabber.org/protocol/disco#items query"`
+	Node    string          `xml:"node,attr,omitempty"`
+	Items   []DiscoveryItem `xml:"item"`
+}
+
+type DiscoveryItem struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/disco#items item"`
+	Jid     string   `xml:"jid,attr"`
+	Node    string   `xml:"node,attr,omitempty"`
+	Name    string   `xml:"name,attr,omitempty"`
+}
+
+// DataForm is a XEP-0004 data form, as used for extended disco information
+// and for form based queries. See http://xmpp.org/extensions/xep-0004.html
+type DataForm struct {
+	XMLName      xml.Name        `xml:"jabber:x:data x"`
+	Type         string          `xml:"type,attr"` // cancel, form, result or submit
+	Title        string          `xml:"title,omitempty"`
+	Instructions []string        `xml:"instructions,omitempty"`
+	Fields       []DataFormField `xml:"field"`
+}
+
+type DataFormField struct {
+	Var    string   `xml:"var,attr,omitempty"`
+	Type   string   `xml:"type,attr,omitempty"`
+	Label  string   `xml:"label,attr,omitempty"`
+	Values []string `xml:"value"`
+}
+
+// FormType returns the value of the hidden FORM_TYPE field, if any.
+func (f *DataForm) FormType() string {
+	if field := f.Field("FORM_TYPE"); field != nil && len(field.Values) > 0 {
+		return field.Values[0]
+	}
+	return ""
+}
+
+// Field returns the field named by v, or nil.
+func (f *DataForm) Field(v string) *DataFormField {
+	for i := range f.Fields {
+		if f.Fields[i].Var == v {
+			return &f.Fields[i]
+		}
+	}
+	return nil
+}
+
 type VersionQuery struct {
 	XMLName xml.Name `xml:"jabber:iq:version query"`
 }
@@ -344,7 +1098,7 @@ type VersionReply struct {
 	XMLName xml.Name `xml:"jabber:iq:version query"`
 	Name    string   `xml:"name"`
 	Version string   `xml:"version"`
-	OS      string   `xml:"os"`
+	OS      string   `xml:"os,omitempty"`
 }
 
 // ErrorReply reflects an XMPP error stanza. See
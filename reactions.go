@@ -0,0 +1,137 @@
+package xmppclient
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Message Reactions, XEP-0444, Message Replies, XEP-0461, and Fallback
+// Indication, XEP-0428
+// http://xmpp.org/extensions/xep-0444.html
+// http://xmpp.org/extensions/xep-0461.html
+// http://xmpp.org/extensions/xep-0428.html
+
+// React sets our reactions to the message id, replacing any we sent before;
+// no reactions removes them all. chatType is the type of the message reacted
+// to, and in groupchat id is the stanza-id the room assigned to it.
+//
+//	<message to='romeo@montague.lit' id='96d73204' type='chat'>
+//	  <reactions id='744f6e18' xmlns='urn:xmpp:reactions:0'>
+//	    <reaction>👋</reaction>
+//	    <reaction>🐢</reaction>
+//	  </reactions>
+//	  <store xmlns="urn:xmpp:hints"/>
+//	</message>
+func (c *Conn) React(to, chatType, id string, reactions ...string) (string, error) {
+	return c.sendMessage(to, "", chatType, func(m *outgoingMessage) {
+		m.content = true
+		fmt.Fprintf(&m.extensions, "<reactions xmlns='%s' id='%s'>", nsReactions, xmlEscape(id))
+		for _, r := range reactions {
+			m.extensions.WriteString("<reaction>" + xmlEscape(r) + "</reaction>")
+		}
+		fmt.Fprintf(&m.extensions, "</reactions><store xmlns='%s'/>", nsHints)
+	})
+}
+
+// InReplyTo marks the message as a reply to the message id sent by to. A
+// non-empty quote is prepended to the body as a fallback for clients without
+// reply support, and marked as such.
+//
+//	<message to='anna@example.com' id='message-id2' type='chat'>
+//	  <body>> Anna wrote:
+//	> We should bake a cake
+//	Great idea!</body>
+//	  <reply to='anna@example.com/laptop' id='message-id1' xmlns='urn:xmpp:reply:0' />
+//	  <fallback xmlns='urn:xmpp:fallback:0' for='urn:xmpp:reply:0'>
+//	    <body start="0" end="36" />
+//	  </fallback>
+//	</message>
+func InReplyTo(to, id, quote string) MessageOption {
+	return func(m *outgoingMessage) {
+		toAttr := ""
+		if to != "" {
+			toAttr = fmt.Sprintf(" to='%s'", xmlEscape(to))
+		}
+		fmt.Fprintf(&m.extensions, "<reply xmlns='%s'%s id='%s'/>", nsReply, toAttr, xmlEscape(id))
+		if quote == "" {
+			return
+		}
+
+		m.body = quote + m.body
+		fmt.Fprintf(
+			&m.extensions,
+			"<fallback xmlns='%s' for='%s'><body start='0' end='%d'/></fallback>",
+			nsFallback,
+			nsReply,
+			utf8.RuneCountInString(quote),
+		)
+	}
+}
+
+// Reply answers original with body, quoting original for clients without
+// reply support, and returns the id of the reply.
+func (c *Conn) Reply(original *ClientMessage, body string) (string, error) {
+	to, chatType, id := original.From, "chat", original.OriginalId()
+	if original.Type == "groupchat" {
+		to, chatType = RemoveResourceFromJid(original.From), "groupchat"
+		if sid := original.StanzaId(to); sid != "" {
+			id = sid
+		}
+	}
+	return c.sendMessage(to, body, chatType, InReplyTo(original.From, id, Quote(original.BodyWithoutFallback(nsReply))))
+}
+
+// Quote formats s as a quotation, each line prefixed with "> ", ending with
+// a newline.
+func Quote(s string) string {
+	if s == "" {
+		return ""
+	}
+	return "> " + strings.Replace(strings.TrimRight(s, "\n"), "\n", "\n> ", -1) + "\n"
+}
+
+// BodyWithoutFallback returns the body without the parts that are only a
+// fallback for the specification ns, such as the quote of a reply
+// (urn:xmpp:reply:0).
+func (this *ClientMessage) BodyWithoutFallback(ns string) string {
+	type span struct{ start, end int }
+	var ranges []span
+	for _, f := range this.Fallbacks {
+		if f.For != ns {
+			continue
+		}
+		if len(f.Bodies) == 0 {
+			return ""
+		}
+		for _, r := range f.Bodies {
+			start, err1 := strconv.Atoi(r.Start)
+			end, err2 := strconv.Atoi(r.End)
+			if err1 != nil || err2 != nil {
+				// Invalid ranges are ignored rather than guessed at.
+				continue
+			}
+			ranges = append(ranges, span{start, end})
+		}
+	}
+	if len(ranges) == 0 {
+		return this.Body
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+
+	body := []rune(this.Body)
+	var b strings.Builder
+	pos := 0
+	for _, r := range ranges {
+		if r.start < pos || r.end < r.start || r.end > len(body) {
+			// Nor are overlapping ones or ones outside the body.
+			continue
+		}
+		b.WriteString(string(body[pos:r.start]))
+		pos = r.end
+	}
+	b.WriteString(string(body[pos:]))
+	return b.String()
+}
@@ -0,0 +1,66 @@
+package xmppclient
+
+import "fmt"
+
+// Message Delivery Receipts, XEP-0184
+// http://xmpp.org/extensions/xep-0184.html
+
+// RequestReceipt asks the recipient to acknowledge delivery. The
+// acknowledgement is reported to a Handler implementing ReceiptHandler, with
+// the id returned by SendMessage.
+//
+//	<message to='northumberland@shakespeare.lit/westminster' id='richard2-4.1.247'>
+//	  <body>My lord, dispatch; read o'er these articles.</body>
+//	  <request xmlns='urn:xmpp:receipts'/>
+//	</message>
+func RequestReceipt() MessageOption {
+	return func(m *outgoingMessage) {
+		m.extensions.WriteString("<request xmlns='" + nsReceipts + "'/>")
+	}
+}
+
+// handleReceipts acknowledges receipt requests in msg and reports receipts
+// carried by it.
+func (c *Conn) handleReceipts(msg *ClientMessage) {
+	// Receipts in carbon copies are for, and answered by, our other
+	// resources.
+	if msg.Carbon != "" {
+		return
+	}
+
+	if msg.Received != nil {
+		if h, ok := c.Handler.(ReceiptHandler); ok {
+			h.RecvReceipt(msg.From, msg.Received.Id)
+		}
+	}
+
+	// Receipts are not sent for groupchat messages, nor for messages without
+	// an id to refer to.
+	if msg.ReceiptRequest == nil || !c.sendReceipts || msg.Id == "" {
+		return
+	}
+	if msg.Type == "groupchat" || msg.Type == "error" {
+		return
+	}
+	c.sendReceipt(msg.From, msg.Id)
+}
+
+// sendReceipt acknowledges delivery of the message id sent by to.
+//
+//	<message from='kingrichard@royalty.england.lit/throne'
+//	    id='bi29sg183b4v'
+//	    to='northumberland@shakespeare.lit/westminster'>
+//	  <received xmlns='urn:xmpp:receipts' id='richard2-4.1.247'/>
+//	</message>
+func (c *Conn) sendReceipt(to, id string) error {
+	_, err := fmt.Fprintf(
+		c.out,
+		"<message to='%s' from='%s' id='%s'><received xmlns='%s' id='%s'/></message>",
+		xmlEscape(to),
+		xmlEscape(c.Jid),
+		c.getId(),
+		nsReceipts,
+		xmlEscape(id),
+	)
+	return err
+}
@@ -0,0 +1,97 @@
+package xmppclient
+
+import (
+	"context"
+	"fmt"
+)
+
+// Message Retraction, XEP-0424, and Message Moderation, XEP-0425
+// http://xmpp.org/extensions/xep-0424.html
+// http://xmpp.org/extensions/xep-0425.html
+
+// retractFallback is the body shown by clients that do not support
+// retractions.
+const retractFallback = "This person attempted to retract a previous message, but it's unsupported by your client."
+
+// Retract asks the given user to remove the chat message we sent with the
+// id originID, and returns the id of the retraction.
+//
+//	<message type='chat' to='lord@capulet.example' id='retract-message-1'>
+//	  <retract id='origin-id-1' xmlns='urn:xmpp:message-retract:1'/>
+//	  <fallback xmlns='urn:xmpp:fallback:0' for='urn:xmpp:message-retract:1'/>
+//	  <body>This person attempted to retract a previous message, but it's unsupported by your client.</body>
+//	  <store xmlns="urn:xmpp:hints"/>
+//	</message>
+func (c *Conn) Retract(to, originID string) (string, error) {
+	return c.sendMessage(to, retractFallback, "chat", Retracts(originID))
+}
+
+// Retracts turns the message into the retraction of the message id, for use
+// with SendMessage, e.g. to retract our own groupchat messages by the room's
+// stanza-id. The message body is only shown by clients without retraction
+// support.
+func Retracts(id string) MessageOption {
+	return func(m *outgoingMessage) {
+		fmt.Fprintf(
+			&m.extensions,
+			"<retract xmlns='%s' id='%s'/><fallback xmlns='%s' for='%s'/><store xmlns='%s'/>",
+			nsRetract,
+			xmlEscape(id),
+			nsFallback,
+			nsRetract,
+			nsHints,
+		)
+	}
+}
+
+// ModerateMessage asks room to remove the message with the room assigned
+// stanzaID, which requires being a moderator. The room announces the
+// retraction to its occupants.
+//
+//	<iq type='set' to='channel@muc.example' id='retract-request-1'>
+//	  <moderate id='stanza-id-1' xmlns='urn:xmpp:message-moderate:1'>
+//	    <retract xmlns='urn:xmpp:message-retract:1'/>
+//	    <reason>This message contains inappropriate content for this forum</reason>
+//	  </moderate>
+//	</iq>
+func (c *Conn) ModerateMessage(ctx context.Context, room, stanzaID, reason string) error {
+	reasonElem := ""
+	if reason != "" {
+		reasonElem = "<reason>" + xmlEscape(reason) + "</reason>"
+	}
+	_, err := c.sendIQ(ctx, room, "set", fmt.Sprintf(
+		"<moderate xmlns='%s' id='%s'><retract xmlns='%s'/>%s</moderate>",
+		nsModerate,
+		xmlEscape(stanzaID),
+		nsRetract,
+		reasonElem,
+	))
+	return err
+}
+
+// IsValidRetraction reports whether retraction may remove original. A
+// moderated retraction must come from the room and name the stanza-id the
+// room gave original; any other retraction must come from the sender of
+// original, as for corrections.
+func IsValidRetraction(original, retraction *ClientMessage) bool {
+	r := retraction.Retract
+	if r == nil {
+		return false
+	}
+	if r.Moderated != nil {
+		room := RemoveResourceFromJid(original.From)
+		return original.Type == "groupchat" && retraction.From == room && r.Id == original.StanzaId(room)
+	}
+
+	if original.Type == "groupchat" {
+		room := RemoveResourceFromJid(original.From)
+		if r.Id != original.StanzaId(room) && r.Id != original.OriginalId() {
+			return false
+		}
+		return retraction.Type == "groupchat" && original.From == retraction.From
+	}
+	if r.Id != original.Id && r.Id != original.OriginalId() {
+		return false
+	}
+	return RemoveResourceFromJid(original.From) == RemoveResourceFromJid(retraction.From)
+}
@@ -0,0 +1,446 @@
+package xmppclient
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 Bytestreams, XEP-0065
+// http://xmpp.org/extensions/xep-0065.html
+
+// How long the target tries each stream host, and how long a connection to
+// our own listener may take to complete the SOCKS5 handshake.
+const socks5ConnectTimeout = 10 * time.Second
+
+// SOCKS5Stream is an established SOCKS5 bytestream with a peer.
+type SOCKS5Stream struct {
+	net.Conn
+	peer string
+	sid  string
+}
+
+// Peer returns the JID at the other end of the stream.
+func (s *SOCKS5Stream) Peer() string { return s.peer }
+
+// Sid returns the stream id.
+func (s *SOCKS5Stream) Sid() string { return s.sid }
+
+// socks5DstAddr is the domain name both parties ask the SOCKS5 server to
+// connect to, identifying the stream.
+func socks5DstAddr(sid, requester, target string) string {
+	h := sha1.Sum([]byte(sid + requester + target))
+	return hex.EncodeToString(h[:])
+}
+
+// DiscoverProxies returns the bytestream proxies of our server, or
+// Config.SOCKS5Proxies if set. Discovered proxies are cached for the life of
+// the connection.
+func (c *Conn) DiscoverProxies(ctx context.Context) ([]StreamHost, error) {
+	c.s5Mu.Lock()
+	proxies := c.s5Proxies
+	c.s5Mu.Unlock()
+	if proxies != nil {
+		return proxies, nil
+	}
+
+	items, err := c.DiscoItems(ctx, c.Domain, "")
+	if err != nil {
+		return nil, err
+	}
+	proxies = []StreamHost{}
+	for _, item := range items {
+		info, err := c.DiscoInfo(ctx, item.Jid, "")
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			continue
+		}
+		isProxy := false
+		for _, id := range info.Identities {
+			if id.Category == "proxy" && id.Type == "bytestreams" {
+				isProxy = true
+			}
+		}
+		if !isProxy {
+			continue
+		}
+
+		// <iq from='requester@example.com/foo' id='uj2c15z9' to='streamer.example.com' type='get'>
+		//   <query xmlns='http://jabber.org/protocol/bytestreams'/>
+		// </iq>
+		iq, err := c.sendIQ(ctx, item.Jid, "get", "<query xmlns='"+nsBytestreams+"'/>")
+		if err != nil {
+			continue
+		}
+		var reply Bytestreams
+		if err = unmarshalQuery(iq, &reply); err != nil {
+			continue
+		}
+		proxies = append(proxies, reply.StreamHosts...)
+	}
+
+	c.s5Mu.Lock()
+	c.s5Proxies = proxies
+	c.s5Mu.Unlock()
+	return proxies, nil
+}
+
+// OpenSOCKS5 offers a bytestream to the full JID to, through our own
+// listener (see Config.SOCKS5Addr) and the proxies of our server, and returns
+// it once the peer connected to one of them.
+//
+//	<iq from='requester@example.com/foo' id='hu3vax16' to='target@example.org/bar' type='set'>
+//	  <query xmlns='http://jabber.org/protocol/bytestreams' sid='vxf9n471bn46' mode='tcp'>
+//	    <streamhost jid='requester@example.com/foo' host='192.168.4.1' port='5086'/>
+//	    <streamhost jid='streamer.example.com' host='24.24.24.1' port='7625'/>
+//	  </query>
+//	</iq>
+func (c *Conn) OpenSOCKS5(ctx context.Context, to string) (*SOCKS5Stream, error) {
+	return c.openSOCKS5(ctx, to, c.getId())
+}
+
+func (c *Conn) openSOCKS5(ctx context.Context, to, sid string) (*SOCKS5Stream, error) {
+	dst := socks5DstAddr(sid, c.Jid, to)
+
+	var hosts []StreamHost
+	var pending chan net.Conn
+	if direct, ok := c.socks5StreamHost(); ok {
+		var cancel func()
+		pending, cancel = c.expectSOCKS5(dst)
+		defer cancel()
+		hosts = append(hosts, direct)
+
+		// Proxies are only a fallback to direct connections; a server
+		// without any is not an error.
+		proxies, _ := c.DiscoverProxies(ctx)
+		hosts = append(hosts, proxies...)
+	} else {
+		proxies, err := c.DiscoverProxies(ctx)
+		if err != nil {
+			return nil, err
+		}
+		hosts = proxies
+	}
+	if len(hosts) == 0 {
+		return nil, errors.New("xmpp: no SOCKS5 stream hosts to offer")
+	}
+
+	query, err := xml.Marshal(Bytestreams{Sid: sid, Mode: "tcp", StreamHosts: hosts})
+	if err != nil {
+		return nil, err
+	}
+	iq, err := c.sendIQ(ctx, to, "set", string(query))
+	if err != nil {
+		return nil, err
+	}
+	var reply Bytestreams
+	if err = unmarshalQuery(iq, &reply); err != nil {
+		return nil, err
+	}
+	if reply.StreamHostUsed == nil {
+		return nil, errors.New("xmpp: SOCKS5 reply without streamhost-used")
+	}
+
+	used := reply.StreamHostUsed.Jid
+	if used == c.Jid && pending != nil {
+		// The target connected before replying, but the handshake may still
+		// be finishing.
+		select {
+		case conn := <-pending:
+			return &SOCKS5Stream{Conn: conn, peer: to, sid: sid}, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	for _, host := range hosts {
+		if host.Jid != used {
+			continue
+		}
+		conn, err := dialSOCKS5(ctx, host, dst)
+		if err != nil {
+			return nil, err
+		}
+		if err = c.activateSOCKS5(ctx, host.Jid, sid, to); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return &SOCKS5Stream{Conn: conn, peer: to, sid: sid}, nil
+	}
+	return nil, errors.New("xmpp: peer used unknown stream host " + used)
+}
+
+// expectSOCKS5 accepts connections to dst on our listener until cancel is
+// called, sending the first one on ch.
+func (c *Conn) expectSOCKS5(dst string) (ch chan net.Conn, cancel func()) {
+	ch = make(chan net.Conn, 1)
+	c.s5Mu.Lock()
+	c.s5Pending[dst] = ch
+	c.s5Mu.Unlock()
+	return ch, func() {
+		c.s5Mu.Lock()
+		if c.s5Pending[dst] == ch {
+			delete(c.s5Pending, dst)
+		}
+		c.s5Mu.Unlock()
+		// A connection that arrived after all is not wanted any more.
+		select {
+		case conn := <-ch:
+			conn.Close()
+		default:
+		}
+	}
+}
+
+// activateSOCKS5 asks proxy to start relaying the stream sid once both
+// parties are connected to it.
+//
+//	<iq from='requester@example.com/foo' id='moi7ljb6' to='streamer.example.com' type='set'>
+//	  <query xmlns='http://jabber.org/protocol/bytestreams' sid='vxf9n471bn46'>
+//	    <activate>target@example.org/bar</activate>
+//	  </query>
+//	</iq>
+func (c *Conn) activateSOCKS5(ctx context.Context, proxy, sid, target string) error {
+	_, err := c.sendIQ(ctx, proxy, "set", fmt.Sprintf(
+		"<query xmlns='%s' sid='%s'><activate>%s</activate></query>",
+		nsBytestreams,
+		xmlEscape(sid),
+		xmlEscape(target),
+	))
+	return err
+}
+
+// answerBytestreams tries the stream hosts offered by a peer in order, once
+// the Handler agreed to. As that takes a while, the reply is sent from
+// another goroutine.
+func (c *Conn) answerBytestreams(iq *ClientIQ) (string, error) {
+	if !c.s5Accept {
+		return "", NewStanzaError("cancel", "service-unavailable")
+	}
+	if iq.Type != "set" {
+		return "", NewStanzaError("cancel", "feature-not-implemented")
+	}
+	var query Bytestreams
+	if err := xml.Unmarshal(iq.Query, &query); err != nil || query.Sid == "" {
+		return "", NewStanzaError("modify", "bad-request")
+	}
+	if query.Mode == "udp" {
+		return "", NewStanzaError("cancel", "feature-not-implemented")
+	}
+	h, ok := c.Handler.(SOCKS5Handler)
+	if !ok || !h.AcceptSOCKS5(iq.From, query.Sid) {
+		return "", NewStanzaError("cancel", "not-acceptable")
+	}
+
+	go func() {
+		s, used, err := c.connectSOCKS5(iq.From, query)
+		if err != nil {
+			c.sendIQError(iq, err)
+			return
+		}
+		if err = c.sendIQResult(iq, fmt.Sprintf("<query xmlns='%s' sid='%s'><streamhost-used jid='%s'/></query>",
+			nsBytestreams,
+			xmlEscape(query.Sid),
+			xmlEscape(used),
+		)); err != nil {
+			s.Close()
+			return
+		}
+		h.RecvSOCKS5(s)
+	}()
+	return "", errAsync
+}
+
+// connectSOCKS5 connects to the first reachable of the stream hosts offered
+// by from.
+func (c *Conn) connectSOCKS5(from string, query Bytestreams) (*SOCKS5Stream, string, error) {
+	dst := socks5DstAddr(query.Sid, from, c.Jid)
+	for _, host := range query.StreamHosts {
+		ctx, cancel := context.WithTimeout(context.Background(), socks5ConnectTimeout)
+		conn, err := dialSOCKS5(ctx, host, dst)
+		cancel()
+		if err == nil {
+			return &SOCKS5Stream{Conn: conn, peer: from, sid: query.Sid}, host.Jid, nil
+		}
+	}
+	return nil, "", NewStanzaError("cancel", "item-not-found")
+}
+
+// dialSOCKS5 connects to host and asks it for a connection to dst, as per
+// RFC 1928 with no authentication and a domain name address.
+func dialSOCKS5(ctx context.Context, host StreamHost, dst string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(host.Host, strconv.Itoa(host.Port)))
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err = socks5Connect(conn, dst); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func socks5Connect(conn net.Conn, dst string) error {
+	if _, err := conn.Write([]byte{5, 1, 0}); err != nil {
+		return err
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != 5 || buf[1] != 0 {
+		return errors.New("xmpp: SOCKS5 server refused authentication method")
+	}
+
+	req := append([]byte{5, 1, 0, 3, byte(len(dst))}, dst...)
+	if _, err := conn.Write(append(req, 0, 0)); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if buf[0] != 5 || buf[1] != 0 {
+		return fmt.Errorf("xmpp: SOCKS5 connect failed with code %d", buf[1])
+	}
+
+	// Skip the bound address and port.
+	var skip int
+	switch buf[3] {
+	case 1:
+		skip = net.IPv4len + 2
+	case 4:
+		skip = net.IPv6len + 2
+	case 3:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return err
+		}
+		skip = int(buf[0]) + 2
+	default:
+		return errors.New("xmpp: SOCKS5 reply with unknown address type")
+	}
+	_, err := io.ReadFull(conn, make([]byte, skip))
+	return err
+}
+
+// socks5StreamHost starts our listener for direct connections on first use,
+// and returns how peers reach it.
+func (c *Conn) socks5StreamHost() (StreamHost, bool) {
+	if c.s5Addr == "" {
+		return StreamHost{}, false
+	}
+	c.s5Once.Do(func() {
+		l, err := net.Listen("tcp", c.s5Addr)
+		if err != nil {
+			return
+		}
+		c.s5Listener = l
+		go func() {
+			<-c.done
+			l.Close()
+		}()
+		go c.serveSOCKS5(l)
+	})
+	if c.s5Listener == nil {
+		return StreamHost{}, false
+	}
+
+	host, _, _ := net.SplitHostPort(c.s5Addr)
+	port := c.s5Listener.Addr().(*net.TCPAddr).Port
+	return StreamHost{Jid: c.Jid, Host: host, Port: port}, true
+}
+
+func (c *Conn) serveSOCKS5(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			conn.SetDeadline(time.Now().Add(socks5ConnectTimeout))
+			ch, err := c.socks5Accept(conn)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			conn.SetDeadline(time.Time{})
+			select {
+			case ch <- conn:
+			default:
+				// Another stream host connected first.
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// socks5Accept runs the server side of the SOCKS5 handshake, only accepting
+// connections to the address of a stream we offered.
+func (c *Conn) socks5Accept(conn net.Conn) (chan net.Conn, error) {
+	buf := make([]byte, 255)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return nil, err
+	}
+	if buf[0] != 5 {
+		return nil, errors.New("xmpp: not a SOCKS5 client")
+	}
+	methods := buf[:buf[1]]
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+	noAuth := false
+	for _, m := range methods {
+		if m == 0 {
+			noAuth = true
+		}
+	}
+	if !noAuth {
+		conn.Write([]byte{5, 0xff})
+		return nil, errors.New("xmpp: SOCKS5 client requires authentication")
+	}
+	if _, err := conn.Write([]byte{5, 0}); err != nil {
+		return nil, err
+	}
+
+	if _, err := io.ReadFull(conn, buf[:5]); err != nil {
+		return nil, err
+	}
+	if buf[0] != 5 || buf[1] != 1 || buf[3] != 3 {
+		conn.Write([]byte{5, 7, 0, 1, 0, 0, 0, 0, 0, 0})
+		return nil, errors.New("xmpp: unsupported SOCKS5 request")
+	}
+	dst := make([]byte, buf[4])
+	if _, err := io.ReadFull(conn, dst); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return nil, err
+	}
+
+	c.s5Mu.Lock()
+	ch, ok := c.s5Pending[string(dst)]
+	c.s5Mu.Unlock()
+	if !ok {
+		conn.Write([]byte{5, 2, 0, 1, 0, 0, 0, 0, 0, 0})
+		return nil, errors.New("xmpp: SOCKS5 connection for unknown stream")
+	}
+
+	reply := append([]byte{5, 0, 0, 3, byte(len(dst))}, dst...)
+	if _, err := conn.Write(append(reply, 0, 0)); err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
@@ -0,0 +1,269 @@
+package xmppclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSOCKS5DstAddr(t *testing.T) {
+	got := socks5DstAddr("vxf9n471bn46", "requester@example.com/foo", "target@example.org/bar")
+	if want := "98b8d688d0f5d895fd41c5e7309a2e9e33ba32ff"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestSOCKS5Handshake(t *testing.T) {
+	c := newConn(new(Config))
+	pending, cancel := c.expectSOCKS5("stream")
+	defer cancel()
+
+	for _, test := range []struct {
+		dst string
+		ok  bool
+	}{
+		{"stream", true},
+		{"unknown", false},
+	} {
+		client, server := net.Pipe()
+		accepted := make(chan error, 1)
+		go func() {
+			ch, err := c.socks5Accept(server)
+			if err == nil && ch != pending {
+				t.Error("accepted for the wrong stream")
+			}
+			accepted <- err
+		}()
+		err := socks5Connect(client, test.dst)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: socks5Connect: %v", test.dst, err)
+		}
+		// Unblocks the rest of a refusal the client did not read.
+		client.Close()
+		if err := <-accepted; (err == nil) != test.ok {
+			t.Errorf("%s: socks5Accept: %v", test.dst, err)
+		}
+		server.Close()
+	}
+}
+
+func TestSOCKS5AcceptRequiresNoAuth(t *testing.T) {
+	c := newConn(new(Config))
+	client, server := net.Pipe()
+	defer client.Close()
+	go c.socks5Accept(server)
+
+	// Username and password only.
+	client.Write([]byte{5, 1, 2})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reply, []byte{5, 0xff}) {
+		t.Errorf("got %v, want no acceptable methods", reply)
+	}
+}
+
+func TestSOCKS5ConnectBoundAddress(t *testing.T) {
+	for _, bound := range [][]byte{
+		{1, 10, 0, 0, 1, 0x1f, 0x90},
+		{4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1f, 0x90},
+		{3, 4, 'h', 'o', 's', 't', 0x1f, 0x90},
+	} {
+		client, server := net.Pipe()
+		go func() {
+			buf := make([]byte, 3+5+3+2)
+			io.ReadFull(server, buf[:3])
+			server.Write([]byte{5, 0})
+			io.ReadFull(server, buf[3:])
+			server.Write(append(append([]byte{5, 0, 0}, bound...), "data"...))
+		}()
+		if err := socks5Connect(client, "dst"); err != nil {
+			t.Fatalf("address type %d: %v", bound[0], err)
+		}
+		data := make([]byte, 4)
+		if _, err := io.ReadFull(client, data); err != nil || string(data) != "data" {
+			t.Errorf("address type %d: read %q, %v after the reply", bound[0], data, err)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+// socks5Proxy is a SOCKS5 bytestream proxy relaying streams once activated.
+type socks5Proxy struct {
+	l         net.Listener
+	mu        sync.Mutex
+	conns     map[string][]net.Conn
+	activated []string
+}
+
+func newSOCKS5Proxy(t *testing.T) *socks5Proxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	p := &socks5Proxy{l: l, conns: make(map[string][]net.Conn)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p
+}
+
+func (p *socks5Proxy) serve(conn net.Conn) {
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf[:3]); err != nil {
+		return
+	}
+	conn.Write([]byte{5, 0})
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return
+	}
+	dst := make([]byte, int(buf[4])+2)
+	if _, err := io.ReadFull(conn, dst); err != nil {
+		return
+	}
+	dst = dst[:len(dst)-2]
+	conn.Write(append(append([]byte{5, 0, 0, 3, byte(len(dst))}, dst...), 0, 0))
+	p.mu.Lock()
+	p.conns[string(dst)] = append(p.conns[string(dst)], conn)
+	p.mu.Unlock()
+}
+
+func (p *socks5Proxy) host() StreamHost {
+	return StreamHost{Jid: "proxy.example.com", Host: "127.0.0.1", Port: p.l.Addr().(*net.TCPAddr).Port}
+}
+
+// route answers the activation requests sent to the proxy, checking that
+// both parties are connected for the stream.
+func (p *socks5Proxy) route(from *fakeServer, stanza xml.StartElement, inner string) bool {
+	if attr(stanza, "to") != "proxy.example.com" {
+		return false
+	}
+	var query Bytestreams
+	xml.Unmarshal([]byte(inner), &query)
+	dst := socks5DstAddr(query.Sid, from.c.Jid, query.Activate)
+	p.mu.Lock()
+	conns := p.conns[dst]
+	p.activated = append(p.activated, dst)
+	p.mu.Unlock()
+	if len(conns) != 2 {
+		go from.srv.Write([]byte("<iq type='error' id='" + attr(stanza, "id") + "' from='proxy.example.com'><error type='cancel'><item-not-found xmlns='" + nsStanzas + "'/></error></iq>"))
+		return true
+	}
+	go relay(conns[0], conns[1])
+	go relay(conns[1], conns[0])
+	from.reply(stanza, "")
+	return true
+}
+
+func relay(dst, src net.Conn) {
+	io.Copy(dst, src)
+	dst.Close()
+}
+
+type socks5Recorder struct {
+	BasicHandler
+	refuse  bool
+	streams chan *SOCKS5Stream
+}
+
+func (h *socks5Recorder) AcceptSOCKS5(peer, sid string) bool {
+	return !h.refuse
+}
+
+func (h *socks5Recorder) RecvSOCKS5(s *SOCKS5Stream) {
+	h.streams <- s
+}
+
+func TestSOCKS5Stream(t *testing.T) {
+	for _, direct := range []bool{true, false} {
+		proxy := newSOCKS5Proxy(t)
+		config := &Config{SOCKS5Proxies: []StreamHost{proxy.host()}}
+		if direct {
+			config.SOCKS5Addr = "127.0.0.1:0"
+		}
+		a, b := link(t, config, &Config{AcceptSOCKS5: true}, proxy.route)
+		h := &socks5Recorder{streams: make(chan *SOCKS5Stream, 1)}
+		b.c.Handler = h
+		go a.c.Listen()
+		go b.c.Listen()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		s, err := a.c.OpenSOCKS5(ctx, "b@example.com/r")
+		cancel()
+		if err != nil {
+			t.Fatalf("direct %v: %v", direct, err)
+		}
+		var peer *SOCKS5Stream
+		select {
+		case peer = <-h.streams:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("direct %v: stream not accepted", direct)
+		}
+		if peer.Peer() != "a@example.com/r" || peer.Sid() != s.Sid() {
+			t.Errorf("direct %v: accepted %s %s, want a@example.com/r %s", direct, peer.Peer(), peer.Sid(), s.Sid())
+		}
+
+		payload := bytes.Repeat([]byte("0123456789"), 100000)
+		go func() {
+			s.Write(payload)
+			s.Close()
+		}()
+		got, err := io.ReadAll(peer)
+		if err != nil || !bytes.Equal(got, payload) {
+			t.Errorf("direct %v: read %d bytes, %v, want %d", direct, len(got), err, len(payload))
+		}
+		peer.Close()
+
+		proxy.mu.Lock()
+		activated := len(proxy.activated)
+		proxy.mu.Unlock()
+		if direct && activated != 0 {
+			t.Errorf("proxy activated for a direct stream")
+		}
+		if !direct && activated != 1 {
+			t.Errorf("proxy activated %d times, want once", activated)
+		}
+	}
+}
+
+// TestSOCKS5Refused checks that offers are refused before the stream hosts
+// are dialed unless both the config and the Handler accept them.
+func TestSOCKS5Refused(t *testing.T) {
+	for _, accept := range []bool{false, true} {
+		proxy := newSOCKS5Proxy(t)
+		a, b := link(t, &Config{SOCKS5Proxies: []StreamHost{proxy.host()}}, &Config{AcceptSOCKS5: accept}, proxy.route)
+		b.c.Handler = &socks5Recorder{refuse: true}
+		go a.c.Listen()
+		go b.c.Listen()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err := a.c.OpenSOCKS5(ctx, "b@example.com/r")
+		cancel()
+		want := "service-unavailable"
+		if accept {
+			want = "not-acceptable"
+		}
+		if e, ok := err.(*ClientError); !ok || e.Any.Local != want {
+			t.Errorf("accept %v: %v, want %s", accept, err, want)
+		}
+		proxy.mu.Lock()
+		if len(proxy.conns) != 0 {
+			t.Errorf("accept %v: proxy dialed", accept)
+		}
+		proxy.mu.Unlock()
+	}
+}
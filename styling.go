@@ -0,0 +1,176 @@
+package xmppclient
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Message Styling, XEP-0393
+// http://xmpp.org/extensions/xep-0393.html
+
+// The kinds of StyleBlock.
+const (
+	BlockPlain = iota
+	BlockQuote
+	BlockPre
+)
+
+// The kinds of StyleSpan.
+const (
+	SpanText = iota
+	SpanStrong
+	SpanEmphasis
+	SpanPre
+	SpanStrike
+)
+
+// StyleBlock is a block of a styled message body: a single line of plain
+// text, a block quote, or a preformatted code block.
+type StyleBlock struct {
+	Kind int
+	// Text is the line of a plain block, or the contents of a preformatted
+	// block without the ``` lines.
+	Text string
+	// Spans is the styled Text of a plain block.
+	Spans []StyleSpan
+	// Children are the blocks inside a block quote.
+	Children []StyleBlock
+}
+
+// StyleSpan is a run of text within a line.
+type StyleSpan struct {
+	Kind int
+	// Text is the text of SpanText and SpanPre spans, which hold no other
+	// spans.
+	Text string
+	// Children are the spans inside strong, emphasis and strike spans.
+	Children []StyleSpan
+}
+
+var spanDirectives = map[rune]int{
+	'*': SpanStrong,
+	'_': SpanEmphasis,
+	'`': SpanPre,
+	'~': SpanStrike,
+}
+
+// ParseStyling parses body into blocks and spans for rendering:
+//
+//	> quoted *strong* and _emphasis_
+//	```
+//	preformatted, not styled
+//	```
+//	`pre` and ~strike~
+func ParseStyling(body string) []StyleBlock {
+	return parseStyleBlocks(strings.Split(body, "\n"))
+}
+
+// Styling parses the body of m, unless the sender asked for it to be shown
+// unstyled, in which case every line is a plain block of text.
+func (m *ClientMessage) Styling() []StyleBlock {
+	if m.Unstyled == nil {
+		return ParseStyling(m.Body)
+	}
+	var blocks []StyleBlock
+	for _, line := range strings.Split(m.Body, "\n") {
+		blocks = append(blocks, StyleBlock{Kind: BlockPlain, Text: line, Spans: []StyleSpan{{Kind: SpanText, Text: line}}})
+	}
+	return blocks
+}
+
+// NoStyling asks the recipient to show the body as is, e.g. for bodies with
+// code or file paths that would be mistaken for styling directives.
+//
+//	<message to='romeo@montague.lit/orchard' type='chat'>
+//	  <body>Soft! *what* light</body>
+//	  <unstyled xmlns='urn:xmpp:styling:0'/>
+//	</message>
+func NoStyling() MessageOption {
+	return func(m *outgoingMessage) {
+		m.extensions.WriteString("<unstyled xmlns='" + nsStyling + "'/>")
+	}
+}
+
+func parseStyleBlocks(lines []string) []StyleBlock {
+	var blocks []StyleBlock
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case strings.HasPrefix(line, "```"):
+			// A code block runs to a line of just ``` or the end of the
+			// enclosing block; text after the opening ``` is ignored.
+			end := i + 1
+			for end < len(lines) && lines[end] != "```" {
+				end++
+			}
+			blocks = append(blocks, StyleBlock{Kind: BlockPre, Text: strings.Join(lines[i+1:end], "\n")})
+			i = end + 1
+
+		case strings.HasPrefix(line, ">"):
+			var quoted []string
+			for ; i < len(lines) && strings.HasPrefix(lines[i], ">"); i++ {
+				quoted = append(quoted, strings.TrimPrefix(lines[i][1:], " "))
+			}
+			blocks = append(blocks, StyleBlock{Kind: BlockQuote, Children: parseStyleBlocks(quoted)})
+
+		default:
+			blocks = append(blocks, StyleBlock{Kind: BlockPlain, Text: line, Spans: parseStyleSpans([]rune(line))})
+			i++
+		}
+	}
+	return blocks
+}
+
+// parseStyleSpans finds the spans of a line. An opening directive must start
+// the line or follow whitespace or another opening directive, and must not be
+// followed by whitespace; the closing one is the next matching directive not
+// preceded by whitespace. Spans without text between the directives are left
+// as plain text.
+func parseStyleSpans(s []rune) []StyleSpan {
+	var spans []StyleSpan
+	text := 0
+	for i := 0; i < len(s); i++ {
+		kind, ok := spanDirectives[s[i]]
+		if !ok || !canOpenSpan(s, i) {
+			continue
+		}
+		end := -1
+		for j := i + 2; j < len(s); j++ {
+			if s[j] == s[i] && !unicode.IsSpace(s[j-1]) {
+				end = j
+				break
+			}
+		}
+		if end == -1 {
+			continue
+		}
+
+		if i > text {
+			spans = append(spans, StyleSpan{Kind: SpanText, Text: string(s[text:i])})
+		}
+		span := StyleSpan{Kind: kind}
+		if kind == SpanPre {
+			span.Text = string(s[i+1 : end])
+		} else {
+			span.Children = parseStyleSpans(s[i+1 : end])
+		}
+		spans = append(spans, span)
+		i = end
+		text = end + 1
+	}
+	if text < len(s) {
+		spans = append(spans, StyleSpan{Kind: SpanText, Text: string(s[text:])})
+	}
+	return spans
+}
+
+func canOpenSpan(s []rune, i int) bool {
+	if i+1 >= len(s) || unicode.IsSpace(s[i+1]) {
+		return false
+	}
+	if i == 0 || unicode.IsSpace(s[i-1]) {
+		return true
+	}
+	_, afterDirective := spanDirectives[s[i-1]]
+	return afterDirective && s[i-1] != s[i]
+}
@@ -0,0 +1,204 @@
+package xmppclient
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// HTTP File Upload, XEP-0363, and Out of Band Data, XEP-0066
+// http://xmpp.org/extensions/xep-0363.html
+// http://xmpp.org/extensions/xep-0066.html
+
+// ErrNoUploadService is returned when the server offers no HTTP upload
+// service.
+var ErrNoUploadService = errors.New("xmpp: no HTTP upload service")
+
+// UploadService is an HTTP upload component of our server.
+type UploadService struct {
+	Jid string
+	// MaxFileSize is the largest file the service accepts, or 0 if it does
+	// not say.
+	MaxFileSize int64
+}
+
+// UploadSlot is where to PUT a file, and where it can be fetched from
+// afterwards.
+type UploadSlot struct {
+	XMLName xml.Name `xml:"urn:xmpp:http:upload:0 slot"`
+	Put     struct {
+		URL     string         `xml:"url,attr"`
+		Headers []UploadHeader `xml:"header"`
+	} `xml:"put"`
+	Get struct {
+		URL string `xml:"url,attr"`
+	} `xml:"get"`
+}
+
+type UploadHeader struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:",chardata"`
+}
+
+// DiscoverUploadService looks among the items of our server for an HTTP
+// upload service. The result is cached for the life of the connection.
+func (c *Conn) DiscoverUploadService(ctx context.Context) (*UploadService, error) {
+	c.uploadMu.Lock()
+	service := c.uploadService
+	c.uploadMu.Unlock()
+	if service != nil {
+		return service, nil
+	}
+
+	items, err := c.DiscoItems(ctx, c.Domain, "")
+	if err != nil {
+		return nil, err
+	}
+	// Some servers handle uploads themselves rather than in a component.
+	jids := []string{c.Domain}
+	for _, item := range items {
+		jids = append(jids, item.Jid)
+	}
+	for _, jid := range jids {
+		info, err := c.DiscoInfo(ctx, jid, "")
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			continue
+		}
+		if !info.HasFeature(nsUpload) {
+			continue
+		}
+
+		service = &UploadService{Jid: jid}
+		for _, form := range info.Forms {
+			if form.FormType() != nsUpload {
+				continue
+			}
+			if f := form.Field("max-file-size"); f != nil && len(f.Values) > 0 {
+				service.MaxFileSize, _ = strconv.ParseInt(f.Values[0], 10, 64)
+			}
+		}
+		c.uploadMu.Lock()
+		c.uploadService = service
+		c.uploadMu.Unlock()
+		return service, nil
+	}
+	return nil, ErrNoUploadService
+}
+
+// RequestUploadSlot asks service for a slot to upload the file name. Slots
+// whose URLs are not https are refused, as XEP-0363 requires.
+//
+//	<iq to='upload.montague.tld' type='get' id='step_03'>
+//	  <request xmlns='urn:xmpp:http:upload:0' filename='très cool.jpg' size='23456' content-type='image/jpeg'/>
+//	</iq>
+func (c *Conn) RequestUploadSlot(ctx context.Context, service, name string, size int64, contentType string) (*UploadSlot, error) {
+	contentTypeAttr := ""
+	if contentType != "" {
+		contentTypeAttr = fmt.Sprintf(" content-type='%s'", xmlEscape(contentType))
+	}
+	iq, err := c.sendIQ(ctx, service, "get", fmt.Sprintf(
+		"<request xmlns='%s' filename='%s' size='%d'%s/>",
+		nsUpload,
+		xmlEscape(name),
+		size,
+		contentTypeAttr,
+	))
+	if err != nil {
+		return nil, err
+	}
+	slot := new(UploadSlot)
+	if err = unmarshalQuery(iq, slot); err != nil {
+		return nil, err
+	}
+	if slot.Put.URL == "" || slot.Get.URL == "" {
+		return nil, errors.New("xmpp: upload slot without URLs")
+	}
+	// The file, and the headers that may authorize the upload, must not
+	// travel in the clear.
+	for _, s := range []string{slot.Put.URL, slot.Get.URL} {
+		if u, err := url.Parse(s); err != nil || u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("xmpp: upload slot URL %q is not https", s)
+		}
+	}
+	return slot, nil
+}
+
+// UploadFile uploads size bytes read from r as the file name to our server's
+// HTTP upload service, and returns the URL it can be downloaded from, e.g.
+// to share with SendURL.
+func (c *Conn) UploadFile(ctx context.Context, r io.Reader, name string, size int64, contentType string) (string, error) {
+	service, err := c.DiscoverUploadService(ctx)
+	if err != nil {
+		return "", err
+	}
+	if service.MaxFileSize > 0 && size > service.MaxFileSize {
+		return "", fmt.Errorf("xmpp: file of %d bytes exceeds the upload limit of %d", size, service.MaxFileSize)
+	}
+
+	slot, err := c.RequestUploadSlot(ctx, service.Jid, name, size, contentType)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", slot.Put.URL, r)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = size
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for _, h := range slot.Put.Headers {
+		// Only these headers may be passed on, and never with line breaks,
+		// so that the service cannot make us send arbitrary requests.
+		switch http.CanonicalHeaderKey(h.Name) {
+		case "Authorization", "Cookie", "Expires":
+			req.Header.Set(h.Name, strings.NewReplacer("\r", "", "\n", "").Replace(h.Value))
+		}
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("xmpp: upload failed: %s", resp.Status)
+	}
+	return slot.Get.URL, nil
+}
+
+// WithOOB attaches url, described by desc, as out of band data.
+//
+//	<message to='MaineBoy@jabber.org/home' type='chat'>
+//	  <body>Yeah, but do you have a license to Jabber?</body>
+//	  <x xmlns='jabber:x:oob'>
+//	    <url>http://www.jabber.org/images/psa-license.jpg</url>
+//	  </x>
+//	</message>
+func WithOOB(url, desc string) MessageOption {
+	return func(m *outgoingMessage) {
+		fmt.Fprintf(&m.extensions, "<x xmlns='%s'><url>%s</url>", nsOOB, xmlEscape(url))
+		if desc != "" {
+			fmt.Fprintf(&m.extensions, "<desc>%s</desc>", xmlEscape(desc))
+		}
+		m.extensions.WriteString("</x>")
+		m.content = true
+	}
+}
+
+// SendURL shares url, such as the result of UploadFile, with the given user
+// or room. The body is the bare URL, which clients recognize to show the
+// file inline.
+func (c *Conn) SendURL(to, chatType, url, desc string) (string, error) {
+	return c.sendMessage(to, url, chatType, WithOOB(url, desc))
+}
@@ -0,0 +1,65 @@
+package xmppclient
+
+import (
+	"context"
+	"encoding/xml"
+	"runtime/debug"
+)
+
+// Software Version, XEP-0092
+// http://xmpp.org/extensions/xep-0092.html
+
+const modulePath = "github.com/bom-d-van/xmppclient"
+
+// QueryVersion asks jid which software it runs.
+//
+//	<iq type='get' to='juliet@capulet.com/balcony' id='version_1'>
+//	  <query xmlns='jabber:iq:version'/>
+//	</iq>
+func (c *Conn) QueryVersion(ctx context.Context, jid string) (*VersionReply, error) {
+	iq, err := c.sendIQ(ctx, jid, "get", "<query xmlns='"+nsVersion+"'/>")
+	if err != nil {
+		return nil, err
+	}
+	reply := new(VersionReply)
+	if err = unmarshalQuery(iq, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// handleVersion answers version queries with v, or with the library defaults
+// when v is nil.
+func (c *Conn) handleVersion(v *VersionReply) {
+	if v == nil {
+		v = &VersionReply{Name: "xmppclient", Version: moduleVersion()}
+	}
+	reply, err := xml.Marshal(v)
+	if err != nil {
+		return
+	}
+
+	c.HandleIQ(nsVersion, "query", func(*ClientIQ) (string, error) {
+		return string(reply), nil
+	})
+	c.RegisterFeature(nsVersion)
+}
+
+// moduleVersion returns the version of this module the binary was built
+// with, if known.
+func moduleVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "devel"
+	}
+	mod := &info.Main
+	for _, dep := range info.Deps {
+		if dep.Path == modulePath {
+			mod = dep
+		}
+	}
+	if mod.Path != modulePath || mod.Version == "" || mod.Version == "(devel)" {
+		return "devel"
+	}
+	return mod.Version
+}
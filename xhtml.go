@@ -0,0 +1,291 @@
+package xmppclient
+
+import (
+	"encoding/xml"
+	"fmt"
+	"html"
+	"net/url"
+	"strings"
+)
+
+// XHTML-IM, XEP-0071
+// http://xmpp.org/extensions/xep-0071.html
+
+// xhtmlElements are the elements of the XEP-0071 recommended profile, with
+// the attributes kept on them besides style.
+var xhtmlElements = map[string][]string{
+	"a":          {"href", "type"},
+	"blockquote": nil,
+	"br":         nil,
+	"cite":       nil,
+	"code":       nil,
+	"em":         nil,
+	"img":        {"alt", "height", "src", "width"},
+	"li":         nil,
+	"ol":         nil,
+	"p":          nil,
+	"span":       nil,
+	"strong":     nil,
+	"ul":         nil,
+}
+
+// xhtmlDropped are elements removed along with their content. Other unknown
+// elements are replaced by their content.
+var xhtmlDropped = map[string]bool{
+	"head":   true,
+	"iframe": true,
+	"object": true,
+	"script": true,
+	"style":  true,
+	"title":  true,
+}
+
+var xhtmlStyles = map[string]bool{
+	"background-color": true,
+	"color":            true,
+	"font-family":      true,
+	"font-size":        true,
+	"font-style":       true,
+	"font-weight":      true,
+	"margin-left":      true,
+	"margin-right":     true,
+	"text-align":       true,
+	"text-decoration":  true,
+}
+
+// HTML returns the XHTML-IM body best matching the preferred languages,
+// sanitized so that it is safe to display: only the elements, attributes,
+// style properties and link schemes of the XEP-0071 recommended profile are
+// kept. It returns "" if the message has no rich body.
+func (this *ClientMessage) HTML(langs ...string) string {
+	if this.XHTML == nil || len(this.XHTML.Bodies) == 0 {
+		return ""
+	}
+	texts := make([]ClientText, 0, len(this.XHTML.Bodies))
+	for _, b := range this.XHTML.Bodies {
+		texts = append(texts, ClientText{Lang: b.Lang, Body: b.Inner})
+	}
+	return SanitizeXHTML(bestText(texts, this.Lang, langs))
+}
+
+// SanitizeXHTML turns the content of an XHTML-IM body into safe HTML.
+// Malformed markup is cut off where the error is.
+func SanitizeXHTML(inner string) string {
+	d := xml.NewDecoder(strings.NewReader("<body xmlns='" + nsXHTML + "'>" + inner + "</body>"))
+	var out strings.Builder
+	// open holds, for every element being copied, the end tag to write, or
+	// "" for elements that were unwrapped or have no end tag.
+	var open []string
+	skip := 0
+
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			break
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if skip > 0 {
+				skip++
+				continue
+			}
+			if t.Name.Space != nsXHTML || xhtmlDropped[t.Name.Local] {
+				skip = 1
+				continue
+			}
+			attrs, ok := xhtmlElements[t.Name.Local]
+			if !ok {
+				open = append(open, "")
+				continue
+			}
+
+			out.WriteString("<" + t.Name.Local)
+			for _, a := range t.Attr {
+				if v, ok := sanitizeXHTMLAttr(t.Name.Local, a, attrs); ok {
+					fmt.Fprintf(&out, " %s=\"%s\"", a.Name.Local, html.EscapeString(v))
+				}
+			}
+			if t.Name.Local == "br" || t.Name.Local == "img" {
+				out.WriteString("/>")
+				open = append(open, "")
+			} else {
+				out.WriteString(">")
+				open = append(open, "</"+t.Name.Local+">")
+			}
+
+		case xml.EndElement:
+			if skip > 0 {
+				skip--
+				continue
+			}
+			if len(open) > 0 {
+				out.WriteString(open[len(open)-1])
+				open = open[:len(open)-1]
+			}
+
+		case xml.CharData:
+			if skip == 0 {
+				out.WriteString(html.EscapeString(string(t)))
+			}
+		}
+	}
+
+	for i := len(open) - 1; i >= 0; i-- {
+		out.WriteString(open[i])
+	}
+	return out.String()
+}
+
+func sanitizeXHTMLAttr(element string, a xml.Attr, allowed []string) (string, bool) {
+	if a.Name.Space != "" {
+		return "", false
+	}
+	if a.Name.Local == "style" {
+		style := sanitizeStyle(a.Value)
+		return style, style != ""
+	}
+
+	ok := false
+	for _, name := range allowed {
+		if name == a.Name.Local {
+			ok = true
+		}
+	}
+	if !ok {
+		return "", false
+	}
+
+	switch a.Name.Local {
+	case "href":
+		return a.Value, hasScheme(a.Value, "http", "https", "mailto", "xmpp")
+	case "src":
+		return a.Value, hasScheme(a.Value, "http", "https")
+	case "height", "width":
+		return a.Value, a.Value != "" && strings.Trim(a.Value, "0123456789") == ""
+	}
+	return a.Value, true
+}
+
+func hasScheme(link string, schemes ...string) bool {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil {
+		return false
+	}
+	for _, s := range schemes {
+		if strings.EqualFold(u.Scheme, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeStyle keeps the allowed properties of a style attribute, dropping
+// values that could load resources or run code.
+func sanitizeStyle(style string) string {
+	var kept []string
+	for _, decl := range strings.Split(style, ";") {
+		colon := strings.IndexByte(decl, ':')
+		if colon == -1 {
+			continue
+		}
+		prop := strings.ToLower(strings.TrimSpace(decl[:colon]))
+		value := strings.TrimSpace(decl[colon+1:])
+		lower := strings.ToLower(value)
+		if !xhtmlStyles[prop] || value == "" || strings.ContainsAny(value, "\\<>\"") ||
+			strings.Contains(lower, "url(") || strings.Contains(lower, "expression") {
+			continue
+		}
+		kept = append(kept, prop+": "+value)
+	}
+	return strings.Join(kept, "; ")
+}
+
+// RichText builds a message body in both XHTML-IM and plain text, the
+// latter using message styling (XEP-0393) for the formatting:
+//
+//	r := new(RichText).Text("build ").Bold("failed").Text(", see ").Link("the log", logURL)
+//	c.SendMessage(to, r.Plain(), "chat", WithXHTML(r))
+type RichText struct {
+	plain strings.Builder
+	html  strings.Builder
+}
+
+// Text adds unformatted text.
+func (r *RichText) Text(s string) *RichText {
+	r.plain.WriteString(s)
+	r.html.WriteString(xmlEscape(s))
+	return r
+}
+
+// Bold adds strongly emphasized text.
+func (r *RichText) Bold(s string) *RichText {
+	return r.styled(s, "*", "<strong>", "</strong>")
+}
+
+// Italic adds emphasized text.
+func (r *RichText) Italic(s string) *RichText {
+	return r.styled(s, "_", "<em>", "</em>")
+}
+
+// Code adds text in a monospace font.
+func (r *RichText) Code(s string) *RichText {
+	return r.styled(s, "`", "<code>", "</code>")
+}
+
+// Strike adds struck through text.
+func (r *RichText) Strike(s string) *RichText {
+	return r.styled(s, "~", "<span style='text-decoration: line-through'>", "</span>")
+}
+
+func (r *RichText) styled(s, directive, open, close string) *RichText {
+	r.plain.WriteString(directive + s + directive)
+	r.html.WriteString(open + xmlEscape(s) + close)
+	return r
+}
+
+// Link adds text linking to href. The plain text shows the address after the
+// text.
+func (r *RichText) Link(text, href string) *RichText {
+	if text == "" || text == href {
+		r.plain.WriteString(href)
+	} else {
+		r.plain.WriteString(text + " <" + href + ">")
+	}
+	fmt.Fprintf(&r.html, "<a href='%s'>%s</a>", xmlEscape(href), xmlEscape(text))
+	return r
+}
+
+// Newline starts a new line.
+func (r *RichText) Newline() *RichText {
+	r.plain.WriteString("\n")
+	r.html.WriteString("<br/>")
+	return r
+}
+
+// Plain returns the plain text version, to be sent as the body.
+func (r *RichText) Plain() string {
+	return r.plain.String()
+}
+
+// XHTML returns the content of the XHTML-IM body.
+func (r *RichText) XHTML() string {
+	return r.html.String()
+}
+
+// WithXHTML adds the XHTML-IM version of r to a message whose body is
+// r.Plain().
+//
+//	<message to='juliet@example.com/balcony' type='chat'>
+//	  <body>Wherefore art thou, Romeo?</body>
+//	  <html xmlns='http://jabber.org/protocol/xhtml-im'>
+//	    <body xmlns='http://www.w3.org/1999/xhtml'>
+//	      <p style='font-weight:bold'>Wherefore art thou, Romeo?</p>
+//	    </body>
+//	  </html>
+//	</message>
+func WithXHTML(r *RichText) MessageOption {
+	return func(m *outgoingMessage) {
+		fmt.Fprintf(&m.extensions, "<html xmlns='%s'><body xmlns='%s'>%s</body></html>", nsXHTMLIM, nsXHTML, r.XHTML())
+		m.content = true
+	}
+}
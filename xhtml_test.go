@@ -0,0 +1,55 @@
+package xmppclient
+
+import "testing"
+
+func TestSanitizeXHTML(t *testing.T) {
+	for _, test := range []struct {
+		name, in, want string
+	}{
+		{"profile", `<p>a <strong>b</strong><br/><em>c</em></p>`, `<p>a <strong>b</strong><br/><em>c</em></p>`},
+		{"unknown element", `<div>a <b>b</b></div>`, `a b`},
+		{"text escaped", `a &lt;script&gt; &amp; "b"`, `a &lt;script&gt; &amp; &#34;b&#34;`},
+
+		{"script", `a<script>alert(1)</script>b`, `ab`},
+		{"style", `a<style>p { color: red }</style>b`, `ab`},
+		{"iframe", `a<iframe src='http://example.com'><p>b</p></iframe>c`, `ac`},
+		{"object", `<object data='http://example.com/x.swf'>a</object>`, ``},
+		{"nested in unknown", `<div><script>alert(1)</script>a</div>`, `a`},
+
+		{"http href", `<a href='http://example.com/?a=1&amp;b="2"'>a</a>`, `<a href="http://example.com/?a=1&amp;b=&#34;2&#34;">a</a>`},
+		{"xmpp href", `<a href='xmpp:romeo@montague.lit'>a</a>`, `<a href="xmpp:romeo@montague.lit">a</a>`},
+		{"javascript href", `<a href='javascript:alert(1)'>a</a>`, `<a>a</a>`},
+		{"mixed case scheme", `<a href='JaVaScRiPt:alert(1)'>a</a>`, `<a>a</a>`},
+		{"leading space", `<a href='  javascript:alert(1)'>a</a>`, `<a>a</a>`},
+		{"control character", "<a href='java&#9;script:alert(1)'>a</a>", `<a>a</a>`},
+		{"data href", `<a href='data:text/html;base64,PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg=='>a</a>`, `<a>a</a>`},
+		{"data src", `<img src='data:image/svg+xml,&lt;svg onload=alert(1)&gt;' alt='x'/>`, `<img alt="x"/>`},
+		{"https src", `<img src='HTTPS://example.com/a.png' width='10' height='1e3'/>`, `<img src="HTTPS://example.com/a.png" width="10"/>`},
+
+		{"event handler", `<p onclick='alert(1)' onmouseover='alert(1)'>a</p>`, `<p>a</p>`},
+		{"event handler on img", `<img src='http://example.com/a.png' onerror='alert(1)'/>`, `<img src="http://example.com/a.png"/>`},
+		{"attribute of another element", `<p href='http://example.com'>a</p>`, `<p>a</p>`},
+
+		{"style kept", `<span style='color: red; font-weight: bold'>a</span>`, `<span style="color: red; font-weight: bold">a</span>`},
+		{"style property", `<span style='position: fixed; color: red'>a</span>`, `<span style="color: red">a</span>`},
+		{"style url", `<span style='background-color: url(http://example.com/t.png); color: red'>a</span>`, `<span style="color: red">a</span>`},
+		{"style url case", `<span style='color: URL(x)'>a</span>`, `<span>a</span>`},
+		{"style expression", `<span style='color: expression(alert(1))'>a</span>`, `<span>a</span>`},
+		{"style expression case", `<span style='COLOR: ExPrEsSiOn(alert(1))'>a</span>`, `<span>a</span>`},
+		{"style escape", `<span style='color: \75rl(x)'>a</span>`, `<span>a</span>`},
+
+		{"namespaced attribute", `<a xmlns:x='urn:x' x:href='javascript:alert(1)' href='http://example.com'>a</a>`, `<a href="http://example.com">a</a>`},
+		{"xml attribute", `<p xml:lang='en'>a</p>`, `<p>a</p>`},
+		{"namespaced element", `<x:p xmlns:x='urn:x'>a</x:p>b`, `b`},
+		{"default namespace", `<p xmlns='urn:x'>a</p>b`, `b`},
+
+		{"body breakout", `a</body><script>alert(1)</script><body>b`, `a`},
+		{"body breakout with markup", `a</body><p xmlns='http://www.w3.org/1999/xhtml' onclick='alert(1)'>b</p>`, `a<p>b</p>`},
+		{"unclosed", `<p><strong>a`, `<p><strong>a</strong></p>`},
+		{"malformed", `<p>a<br>b</p>c`, `<p>a<br/>b</p>`},
+	} {
+		if got := SanitizeXHTML(test.in); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}